@@ -3,8 +3,13 @@ package config
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/btschwartz12/autodeploy/model"
@@ -14,7 +19,16 @@ import (
 )
 
 const (
-	defaultFlowTimeout = model.Duration(5 * time.Minute)
+	defaultFlowTimeout         = model.Duration(5 * time.Minute)
+	defaultHealthcheckInterval = model.Duration(2 * time.Second)
+	defaultHealthcheckTimeout  = model.Duration(5 * time.Second)
+	defaultDatabasePath        = "autodeploy.db"
+	defaultWorkflowTimeout     = model.Duration(30 * time.Minute)
+	defaultChecksTimeout       = model.Duration(30 * time.Minute)
+	defaultReleasesKeep        = 5
+	defaultShutdownGracePeriod = model.Duration(5 * time.Minute)
+	defaultResumeMaxAge        = model.Duration(time.Hour)
+	defaultDedupeWindow        = model.Duration(24 * time.Hour)
 )
 
 func New(yamlPath string, testFlag bool) (*model.Config, error) {
@@ -31,6 +45,10 @@ func New(yamlPath string, testFlag bool) (*model.Config, error) {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
+	if err := resolveSecrets(c); err != nil {
+		return nil, err
+	}
+
 	if c.WebhookSecret == "" {
 		return nil, fmt.Errorf("webhook_secret must be set")
 	}
@@ -47,16 +65,36 @@ func New(yamlPath string, testFlag bool) (*model.Config, error) {
 		return nil, fmt.Errorf("hostname must be set")
 	}
 
+	if c.DatabasePath == "" {
+		c.DatabasePath = defaultDatabasePath
+	}
+
+	if c.ShutdownGracePeriod == 0 {
+		c.ShutdownGracePeriod = defaultShutdownGracePeriod
+	}
+
+	if c.ResumeMaxAge == 0 {
+		c.ResumeMaxAge = defaultResumeMaxAge
+	}
+
+	if c.DedupeWindow == 0 {
+		c.DedupeWindow = defaultDedupeWindow
+	}
+
 	if len(c.Services) == 0 {
 		return nil, fmt.Errorf("at least one service must be defined")
 	}
 
 	for name, s := range c.Services {
+		// validate fills in defaults that depend on the name
+		s.Name = name
 		if err := validate(&s, testFlag); err != nil {
 			return nil, fmt.Errorf("service %s: %w", name, err)
 		}
-		s.Name = name
 		s.Hostname = c.Hostname
+		if s.Environment == "" {
+			s.Environment = name
+		}
 		c.Services[name] = s
 	}
 
@@ -73,12 +111,87 @@ func validate(s *model.Service, testFlag bool) error {
 	if s.HealthcheckURL == "" {
 		return fmt.Errorf("healthcheck_url must be set")
 	}
+	if s.Subdir != "" && !filepath.IsLocal(s.Subdir) {
+		return fmt.Errorf("subdir must be a relative path inside path: %s", s.Subdir)
+	}
+	for _, p := range s.SharedPaths {
+		if p = strings.TrimSuffix(p, "/"); !filepath.IsLocal(p) {
+			return fmt.Errorf("shared path must be a relative path inside the service directory: %s", p)
+		}
+	}
 	if s.HasSystemdService() && s.ComposeService {
 		return fmt.Errorf("systemd_service and compose_service are mutually exclusive")
 	}
+	if s.Preview != nil {
+		if !s.ComposeService {
+			return fmt.Errorf("preview requires compose_service")
+		}
+		if s.Preview.Path == "" {
+			return fmt.Errorf("preview.path must be set")
+		}
+		if s.Preview.BasePort <= 0 {
+			return fmt.Errorf("preview.base_port must be set")
+		}
+	}
+	if s.Releases != nil && s.Releases.Keep == 0 {
+		s.Releases.Keep = defaultReleasesKeep
+	}
+	if s.Releases != nil && s.Releases.Keep < 0 {
+		return fmt.Errorf("releases.keep must not be negative")
+	}
+	// releases are built in their own directory, so compose can't name the
+	// project after the working directory
+	if s.Releases != nil && s.ComposeService && s.ComposeProject == "" {
+		s.ComposeProject = strings.ToLower(s.Name)
+	}
+	switch s.SyncPolicy {
+	case "":
+		s.SyncPolicy = model.SyncStrict
+	case model.SyncStrict, model.SyncFastForward, model.SyncForce:
+	default:
+		return fmt.Errorf("invalid sync_policy: %s", s.SyncPolicy)
+	}
+	switch s.DirtyWorktree {
+	case "":
+		s.DirtyWorktree = model.DirtyFail
+	case model.DirtyFail, model.DirtyStash, model.DirtyDiscard, model.DirtyIgnoreUntracked:
+	default:
+		return fmt.Errorf("invalid dirty_worktree: %s", s.DirtyWorktree)
+	}
+	switch s.Trigger {
+	case "":
+		s.Trigger = model.TriggerPush
+	case model.TriggerPush, model.TriggerRelease, model.TriggerTag:
+	case model.TriggerWorkflowRun:
+		if s.Workflow == "" {
+			return fmt.Errorf("workflow must be set for trigger %s", s.Trigger)
+		}
+	default:
+		return fmt.Errorf("invalid trigger: %s", s.Trigger)
+	}
+	for _, ref := range s.Refs {
+		if _, err := path.Match(ref, ""); err != nil {
+			return fmt.Errorf("invalid ref pattern %q: %w", ref, err)
+		}
+	}
+	patterns := slices.Concat(s.Paths, s.IgnorePaths, s.DiscardIgnore)
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid path pattern %q: %w", pattern, err)
+		}
+	}
 	if s.FlowTimeout == 0 {
 		s.FlowTimeout = model.Duration(defaultFlowTimeout)
 	}
+	if s.ChecksTimeout == 0 {
+		s.ChecksTimeout = defaultChecksTimeout
+	}
+	if s.WorkflowTimeout == 0 {
+		s.WorkflowTimeout = defaultWorkflowTimeout
+	}
+	if err := validateHealthcheck(&s.Healthcheck); err != nil {
+		return fmt.Errorf("healthcheck: %w", err)
+	}
 	fileInfo, err := os.Stat(s.Path)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
@@ -89,6 +202,16 @@ func validate(s *model.Service, testFlag bool) error {
 	if !fileInfo.IsDir() {
 		return fmt.Errorf("path is not a directory: %s", s.Path)
 	}
+	// in release mode the repository is cloned on the first deployment
+	if s.Releases != nil {
+		return nil
+	}
+	if s.Subdir != "" {
+		fileInfo, err = os.Stat(s.WorkDir())
+		if err != nil || !fileInfo.IsDir() {
+			return fmt.Errorf("subdir is not a directory: %s", s.WorkDir())
+		}
+	}
 	// make sure there is a .git directory
 	gitDir := filepath.Join(s.Path, ".git")
 	_, err = os.Stat(gitDir)
@@ -118,3 +241,32 @@ func validate(s *model.Service, testFlag bool) error {
 	}
 	return nil
 }
+
+func validateHealthcheck(h *model.Healthcheck) error {
+	if len(h.ExpectedStatus) == 0 {
+		h.ExpectedStatus = []int{http.StatusOK}
+	}
+	for _, code := range h.ExpectedStatus {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid expected_status: %d", code)
+		}
+	}
+	if h.BodyRegex != "" {
+		if _, err := regexp.Compile(h.BodyRegex); err != nil {
+			return fmt.Errorf("invalid body_regex: %w", err)
+		}
+	}
+	if h.Interval < 0 || h.Timeout < 0 || h.Successes < 0 {
+		return fmt.Errorf("interval, timeout and successes must not be negative")
+	}
+	if h.Interval == 0 {
+		h.Interval = defaultHealthcheckInterval
+	}
+	if h.Timeout == 0 {
+		h.Timeout = defaultHealthcheckTimeout
+	}
+	if h.Successes == 0 {
+		h.Successes = 1
+	}
+	return nil
+}
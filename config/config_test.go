@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -20,12 +21,20 @@ github_token: your-github-token
 services:
   service1:
     repo: "https://github.com/example/repo1"
+    refs:
+      - refs/heads/main
+      - refs/tags/v*
     path: "/path/to/service1"
     systemd_service: "service1"
     healthcheck_url: "http://localhost:8080/health"
     compose_service: false
     build_command: "make build"
     flow_timeout: 5m
+    healthcheck:
+      expected_status: [200, 204]
+      body_regex: "^ok$"
+      interval: 500ms
+      successes: 3
 
   service2:
     repo: "https://github.com/example/repo2"
@@ -73,6 +82,7 @@ func TestGenerateConfigWithValidPaths(t *testing.T) {
 	assert.Equal(t, "/postreceive", config.WebhookURLSuffix)
 	assert.Equal(t, "your-webhook-secret", config.WebhookSecret)
 	assert.Equal(t, "your-github-token", config.GithubToken)
+	assert.Equal(t, defaultDatabasePath, config.DatabasePath)
 
 	assert.Contains(t, config.Services, "service1")
 	assert.Contains(t, config.Services, "service2")
@@ -82,11 +92,17 @@ func TestGenerateConfigWithValidPaths(t *testing.T) {
 	assert.Equal(t, "service1", service1.Name)
 	assert.Equal(t, time.Duration(5*time.Minute).String(), service1.FlowTimeout.String())
 	assert.Equal(t, "https://github.com/example/repo1", service1.Repo)
+	assert.Equal(t, []string{"refs/heads/main", "refs/tags/v*"}, service1.Refs)
 	assert.Equal(t, service1Path, service1.Path)
 	assert.Equal(t, "service1", service1.SystemdService)
 	assert.Equal(t, "http://localhost:8080/health", service1.HealthcheckURL)
 	assert.False(t, service1.ComposeService)
 	assert.Equal(t, "make build", service1.BuildCommand)
+	assert.Equal(t, []int{200, 204}, service1.Healthcheck.ExpectedStatus)
+	assert.Equal(t, "^ok$", service1.Healthcheck.BodyRegex)
+	assert.Equal(t, (500 * time.Millisecond).String(), service1.Healthcheck.Interval.String())
+	assert.Equal(t, 3, service1.Healthcheck.Successes)
+	assert.Equal(t, time.Duration(defaultHealthcheckTimeout).String(), service1.Healthcheck.Timeout.String())
 
 	service2 := config.Services["service2"]
 	assert.Equal(t, "service2", service2.Name)
@@ -98,6 +114,9 @@ func TestGenerateConfigWithValidPaths(t *testing.T) {
 	assert.False(t, service2.ComposeService)
 	assert.Equal(t, "go build ./...", service2.BuildCommand)
 	assert.ElementsMatch(t, []string{"deploy-other-thing", "notify"}, service2.TriggerWorkflows)
+	assert.Equal(t, []int{200}, service2.Healthcheck.ExpectedStatus)
+	assert.Equal(t, time.Duration(defaultHealthcheckInterval).String(), service2.Healthcheck.Interval.String())
+	assert.Equal(t, 1, service2.Healthcheck.Successes)
 
 	service3 := config.Services["service3"]
 	assert.Equal(t, "service3", service3.Name)
@@ -140,3 +159,163 @@ func TestServiceValidation(t *testing.T) {
 	assert.Error(t, err)
 	assert.ErrorContains(t, err, "systemd_service and compose_service are mutually exclusive")
 }
+
+func TestHealthcheckValidation(t *testing.T) {
+	s := &model.Service{
+		Repo:           "ff",
+		Path:           "ff",
+		HealthcheckURL: "ff",
+		Healthcheck: model.Healthcheck{
+			BodyRegex: "(",
+		},
+	}
+	err := validate(s, true)
+	assert.Error(t, err)
+	assert.ErrorContains(t, err, "invalid body_regex")
+
+	s.Healthcheck = model.Healthcheck{
+		ExpectedStatus: []int{42},
+	}
+	err = validate(s, true)
+	assert.Error(t, err)
+	assert.ErrorContains(t, err, "invalid expected_status: 42")
+}
+
+func TestRefsValidation(t *testing.T) {
+	s := &model.Service{
+		Repo:           "ff",
+		Path:           "ff",
+		HealthcheckURL: "ff",
+		Refs:           []string{"refs/tags/[v"},
+	}
+	err := validate(s, true)
+	assert.Error(t, err)
+	assert.ErrorContains(t, err, `invalid ref pattern "refs/tags/[v"`)
+
+	s.Refs = nil
+	s.IgnorePaths = []string{"docs/[a"}
+	err = validate(s, true)
+	assert.Error(t, err)
+	assert.ErrorContains(t, err, `invalid path pattern "docs/[a"`)
+}
+
+func TestSubdirValidation(t *testing.T) {
+	s := &model.Service{
+		Repo:           "ff",
+		Path:           "ff",
+		HealthcheckURL: "ff",
+		Subdir:         "../other",
+	}
+	err := validate(s, true)
+	assert.Error(t, err)
+	assert.ErrorContains(t, err, "subdir must be a relative path inside path")
+
+	s.Path = t.TempDir()
+	assert.NoError(t, os.Mkdir(filepath.Join(s.Path, ".git"), 0o755))
+	s.Subdir = "services/api"
+	err = validate(s, true)
+	assert.Error(t, err)
+	assert.ErrorContains(t, err, "subdir is not a directory")
+
+	assert.NoError(t, os.MkdirAll(s.WorkDir(), 0o755))
+	assert.NoError(t, validate(s, true))
+}
+
+func TestTriggerValidation(t *testing.T) {
+	s := &model.Service{
+		Repo:           "ff",
+		Path:           "ff",
+		HealthcheckURL: "ff",
+		Trigger:        "schedule",
+	}
+	err := validate(s, true)
+	assert.Error(t, err)
+	assert.ErrorContains(t, err, "invalid trigger: schedule")
+
+	s.Trigger = ""
+	s.SyncPolicy = "rebase"
+	err = validate(s, true)
+	assert.Error(t, err)
+	assert.ErrorContains(t, err, "invalid sync_policy: rebase")
+
+	s.SyncPolicy = ""
+	s.DirtyWorktree = "commit"
+	err = validate(s, true)
+	assert.Error(t, err)
+	assert.ErrorContains(t, err, "invalid dirty_worktree: commit")
+
+	s.DirtyWorktree = ""
+	s.Trigger = model.TriggerWorkflowRun
+	err = validate(s, true)
+	assert.Error(t, err)
+	assert.ErrorContains(t, err, "workflow must be set for trigger workflow_run")
+}
+
+func TestPreviewValidation(t *testing.T) {
+	s := &model.Service{
+		Repo:           "ff",
+		Path:           "ff",
+		HealthcheckURL: "ff",
+		SystemdService: "ff",
+		Preview:        &model.Preview{Path: "/srv/previews", BasePort: 9000},
+	}
+	err := validate(s, true)
+	assert.Error(t, err)
+	assert.ErrorContains(t, err, "preview requires compose_service")
+
+	s.SystemdService = ""
+	s.ComposeService = true
+	s.Preview.BasePort = 0
+	err = validate(s, true)
+	assert.Error(t, err)
+	assert.ErrorContains(t, err, "preview.base_port must be set")
+}
+
+func TestReleasesValidation(t *testing.T) {
+	s := &model.Service{
+		Name:           "API",
+		Repo:           "ff",
+		Path:           t.TempDir(),
+		HealthcheckURL: "ff",
+		ComposeService: true,
+		Releases:       &model.Releases{Keep: -1},
+	}
+	err := validate(s, true)
+	assert.Error(t, err)
+	assert.ErrorContains(t, err, "releases.keep must not be negative")
+
+	// the path doesn't need to be a git repository yet
+	dir := t.TempDir()
+	config := fmt.Sprintf(`
+hostname: host
+webhook_secret: secret
+webhook_url_suffix: /postreceive
+github_token: token
+services:
+  API:
+    repo: example/api
+    path: %s
+    healthcheck_url: http://localhost:8080/health
+    compose_service: true
+    releases: {}
+`, dir)
+	yamlPath := filepath.Join(dir, "config.yaml")
+	assert.NoError(t, os.WriteFile(yamlPath, []byte(config), 0o644))
+	c, err := New(yamlPath, true)
+	assert.NoError(t, err)
+	api := c.Services["API"]
+	assert.Equal(t, 5, api.Releases.Keep)
+	assert.Equal(t, "api", api.ComposeProject)
+}
+
+func TestSharedPathsValidation(t *testing.T) {
+	s := &model.Service{
+		Repo:           "ff",
+		Path:           "ff",
+		HealthcheckURL: "ff",
+		SharedPaths:    []string{".env", "../data/"},
+	}
+	err := validate(s, true)
+	assert.Error(t, err)
+	assert.ErrorContains(t, err, "shared path must be a relative path inside the service directory: ../data")
+}
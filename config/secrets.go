@@ -0,0 +1,79 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/btschwartz12/autodeploy/model"
+)
+
+var envVarPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// resolveSecrets fills in the secret fields of c, so that config.yaml can be
+// kept without any secrets in it. A secret field can refer to environment
+// variables as ${NAME}, or be read from the file its _file variant points
+// to, whose path can refer to environment variables too, like systemd's
+// ${CREDENTIALS_DIRECTORY}.
+func resolveSecrets(c *model.Config) error {
+	secrets := []struct {
+		name  string
+		value *string
+		file  string
+	}{
+		{"github_token", &c.GithubToken, c.GithubTokenFile},
+		{"webhook_secret", &c.WebhookSecret, c.WebhookSecretFile},
+		{"api_token", &c.APIToken, c.APITokenFile},
+	}
+	for _, s := range secrets {
+		if err := resolveSecret(s.name, s.value, s.file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func resolveSecret(name string, value *string, file string) error {
+	if file == "" {
+		v, err := expandEnv(*value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		*value = v
+		return nil
+	}
+	if *value != "" {
+		return fmt.Errorf("%s and %s_file are mutually exclusive", name, name)
+	}
+	path, err := expandEnv(file)
+	if err != nil {
+		return fmt.Errorf("%s_file: %w", name, err)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("%s_file: failed to read secret: %w", name, err)
+	}
+	// files written by editors or echo end in a newline
+	*value = strings.TrimRight(string(contents), "\r\n")
+	return nil
+}
+
+// expandEnv replaces every ${NAME} in s with the environment variable NAME.
+// Unlike os.ExpandEnv, a variable that is not set is an error rather than an
+// empty secret.
+func expandEnv(s string) (string, error) {
+	missing := make([]string, 0)
+	expanded := envVarPattern.ReplaceAllStringFunc(s, func(m string) string {
+		name := envVarPattern.FindStringSubmatch(m)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btschwartz12/autodeploy/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveSecrets(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "webhook"), []byte("from-file\n"), 0o600))
+	t.Setenv("TEST_GITHUB_TOKEN", "from-env")
+	t.Setenv("TEST_CREDENTIALS_DIRECTORY", dir)
+
+	c := &model.Config{
+		GithubToken:       "ghp_${TEST_GITHUB_TOKEN}",
+		WebhookSecretFile: "${TEST_CREDENTIALS_DIRECTORY}/webhook",
+		APIToken:          "plain",
+	}
+	assert.NoError(t, resolveSecrets(c))
+	assert.Equal(t, "ghp_from-env", c.GithubToken)
+	assert.Equal(t, "from-file", c.WebhookSecret)
+	assert.Equal(t, "plain", c.APIToken)
+}
+
+func TestResolveSecretsErrors(t *testing.T) {
+	err := resolveSecrets(&model.Config{GithubToken: "${TEST_UNSET_TOKEN}"})
+	assert.EqualError(t, err, "github_token: environment variable TEST_UNSET_TOKEN is not set")
+
+	err = resolveSecrets(&model.Config{WebhookSecretFile: "${TEST_UNSET_DIR}/webhook"})
+	assert.EqualError(t, err, "webhook_secret_file: environment variable TEST_UNSET_DIR is not set")
+
+	missing := filepath.Join(t.TempDir(), "missing")
+	err = resolveSecrets(&model.Config{APITokenFile: missing})
+	assert.ErrorContains(t, err, "api_token_file: failed to read secret")
+	assert.ErrorContains(t, err, missing)
+
+	err = resolveSecrets(&model.Config{APIToken: "token", APITokenFile: missing})
+	assert.EqualError(t, err, "api_token and api_token_file are mutually exclusive")
+}
@@ -16,7 +16,7 @@ func (d *Deployer) activate(ctx context.Context, service *model.Service) error {
 		d.logger.Infow("restarted systemd service", "service", service.Name)
 	}
 	if service.ComposeService {
-		err := runCommand(ctx, service, true, "docker", "compose", "up", "-d")
+		err := runCommand(ctx, service, true, composeCommand(service, "up", "-d")...)
 		if err != nil {
 			return fmt.Errorf("failed to start docker-compose service: %w", err)
 		}
@@ -0,0 +1,162 @@
+package deploy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btschwartz12/autodeploy/model"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// getTestRemote makes an upstream repository with two commits and a tag on
+// the first one, and a clone of it at the first commit whose autodeploy
+// remote points at the upstream.
+func getTestRemote(t *testing.T) (upstream *git.Repository, upstreamDir, cloneDir string, shas []string) {
+	upstreamDir = t.TempDir()
+	upstream, err := git.PlainInit(upstreamDir, false)
+	assert.NoError(t, err)
+	shas = append(shas, commitFile(t, upstream, upstreamDir, "version", "1"))
+	_, err = upstream.CreateTag("v1", plumbing.NewHash(shas[0]), nil)
+	assert.NoError(t, err)
+
+	cloneDir = t.TempDir()
+	clone, err := git.PlainClone(cloneDir, false, &git.CloneOptions{URL: upstreamDir})
+	assert.NoError(t, err)
+	_, err = clone.CreateRemote(&config.RemoteConfig{
+		Name: "autodeploy",
+		URLs: []string{upstreamDir},
+	})
+	assert.NoError(t, err)
+
+	shas = append(shas, commitFile(t, upstream, upstreamDir, "version", "2"))
+	return upstream, upstreamDir, cloneDir, shas
+}
+
+func readVersion(t *testing.T, dir string) string {
+	version, err := os.ReadFile(filepath.Join(dir, "version"))
+	assert.NoError(t, err)
+	return string(version)
+}
+
+func TestPullCheckout(t *testing.T) {
+	_, _, dir, shas := getTestRemote(t)
+	deployer := New(zap.NewNop().Sugar(), "", nil)
+	service := &model.Service{Name: "test", Path: dir}
+
+	// a branch on the remote
+	event := &model.PushEvent{Ref: "refs/heads/master", Trigger: model.TriggerManual}
+	assert.NoError(t, deployer.pull(context.Background(), service, event))
+	assert.Equal(t, shas[0], event.BeforeSha)
+	assert.Equal(t, shas[1], event.AfterSha)
+	assert.Equal(t, "2", readVersion(t, dir))
+
+	// a tag
+	event = &model.PushEvent{Ref: "v1", Trigger: model.TriggerManual}
+	assert.NoError(t, deployer.pull(context.Background(), service, event))
+	assert.Equal(t, shas[1], event.BeforeSha)
+	assert.Equal(t, shas[0], event.AfterSha)
+	assert.Equal(t, "1", readVersion(t, dir))
+
+	// a sha
+	event = &model.PushEvent{Ref: shas[1], Trigger: model.TriggerManual}
+	assert.NoError(t, deployer.pull(context.Background(), service, event))
+	assert.Equal(t, shas[1], event.AfterSha)
+	assert.Equal(t, "2", readVersion(t, dir))
+
+	sha, err := deployer.CurrentSha(service)
+	assert.NoError(t, err)
+	assert.Equal(t, shas[1], sha)
+
+	event = &model.PushEvent{Ref: "nope", Trigger: model.TriggerManual}
+	assert.ErrorContains(t, deployer.pull(context.Background(), service, event), "could not resolve ref: nope")
+}
+
+func TestPullSyncPolicy(t *testing.T) {
+	upstream, upstreamDir, dir, shas := getTestRemote(t)
+	// the push for shas[1] was missed
+	shas = append(shas, commitFile(t, upstream, upstreamDir, "version", "3"))
+	getEvent := func() *model.PushEvent {
+		return &model.PushEvent{
+			BeforeSha: shas[1],
+			AfterSha:  shas[2],
+			Commits:   []model.Commit{{Sha: shas[2]}},
+			Trigger:   model.TriggerPush,
+		}
+	}
+	deployer := New(zap.NewNop().Sugar(), "", nil)
+	service := &model.Service{Name: "test", Path: dir, SyncPolicy: model.SyncStrict}
+
+	err := deployer.pull(context.Background(), service, getEvent())
+	assert.ErrorContains(t, err, "does not match before_sha")
+
+	// a local commit makes the worktree diverge
+	clone, err := git.PlainOpen(dir)
+	assert.NoError(t, err)
+	local := commitFile(t, clone, dir, "local", "x")
+
+	service.SyncPolicy = model.SyncFastForward
+	err = deployer.pull(context.Background(), service, getEvent())
+	assert.ErrorContains(t, err, "is not an ancestor of after_sha")
+
+	service.SyncPolicy = model.SyncForce
+	out := newOutput(maxOutputSize)
+	ctx := withOutput(context.Background(), out)
+	event := getEvent()
+	assert.NoError(t, deployer.pull(ctx, service, event))
+	assert.Equal(t, "3", readVersion(t, dir))
+	// a rollback goes back to what was running, not the missed push
+	assert.Equal(t, local, event.BeforeSha)
+	texts := lineTexts(out.Lines())
+	assert.Equal(t, []string{
+		"force: discarding local commit " + shortSha(local) + " test commit",
+		"force: also deploying " + shortSha(shas[1]) + " test commit, which was not part of the push",
+	}, texts)
+
+	// fast-forward from shas[0] to shas[2]
+	assert.NoError(t, deployer.reset(service, shas[0]))
+	service.SyncPolicy = model.SyncFastForward
+	out = newOutput(maxOutputSize)
+	ctx = withOutput(context.Background(), out)
+	event = getEvent()
+	assert.NoError(t, deployer.pull(ctx, service, event))
+	assert.Equal(t, "3", readVersion(t, dir))
+	assert.Equal(t, shas[0], event.BeforeSha)
+	assert.Equal(t, []string{
+		"fast-forward: also deploying " + shortSha(shas[1]) + " test commit, which was not part of the push",
+	}, lineTexts(out.Lines()))
+}
+
+func TestPreSharedPaths(t *testing.T) {
+	_, _, dir, shas := getTestRemote(t)
+	deployer := New(zap.NewNop().Sugar(), "", nil)
+	service := &model.Service{Name: "test", Path: dir, SharedPaths: []string{".env", "uploads/"}}
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, ".env"), []byte("A=1"), 0o644))
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "uploads"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "uploads", "a.png"), nil, 0o644))
+
+	event := &model.PushEvent{BeforeSha: shas[0], AfterSha: shas[1], Trigger: model.TriggerPush}
+	assert.NoError(t, deployer.pre(context.Background(), service, event))
+	assert.Equal(t, "2", readVersion(t, dir))
+	assert.FileExists(t, filepath.Join(dir, ".env"))
+	assert.FileExists(t, filepath.Join(dir, "uploads", "a.png"))
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "stray"), nil, 0o644))
+	event = &model.PushEvent{Ref: "v1", Trigger: model.TriggerManual}
+	assert.ErrorContains(t, deployer.pre(context.Background(), service, event), "worktree is not clean")
+
+	// checking out and rolling back leave them alone too
+	assert.NoError(t, os.Remove(filepath.Join(dir, "stray")))
+	event = &model.PushEvent{Ref: "v1", Trigger: model.TriggerManual}
+	assert.NoError(t, deployer.pre(context.Background(), service, event))
+	assert.Equal(t, "1", readVersion(t, dir))
+	assert.NoError(t, deployer.reset(service, shas[1]))
+	assert.Equal(t, "2", readVersion(t, dir))
+	assert.FileExists(t, filepath.Join(dir, ".env"))
+	assert.FileExists(t, filepath.Join(dir, "uploads", "a.png"))
+}
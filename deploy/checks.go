@@ -0,0 +1,143 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v68/github"
+
+	"github.com/btschwartz12/autodeploy/model"
+)
+
+// checksPollInterval is how often the required checks are polled.
+var checksPollInterval = 15 * time.Second
+
+const checkPending = "pending"
+
+// ChecksError is returned when a deployment is skipped because the required
+// checks on its commit did not pass.
+type ChecksError struct {
+	Sha string
+	// Checks holds the state of every required check that did not succeed.
+	Checks map[string]string
+}
+
+func (e *ChecksError) Error() string {
+	checks := make([]string, 0, len(e.Checks))
+	for name, state := range e.Checks {
+		checks = append(checks, fmt.Sprintf("%s (%s)", name, state))
+	}
+	slices.Sort(checks)
+	return fmt.Sprintf("required checks did not pass on %s: %s", shortSha(e.Sha), strings.Join(checks, ", "))
+}
+
+// NeedsChecks reports whether event has to wait for the service's required
+// checks. Manual deployments and rollbacks are explicit requests and never
+// wait.
+func NeedsChecks(service *model.Service, event *model.PushEvent) bool {
+	return len(service.RequireChecks) > 0 && event.Trigger == model.TriggerPush
+}
+
+// waitChecks polls the commit statuses and check runs of event.AfterSha until
+// all of the service's required checks succeeded. It returns a *ChecksError
+// as soon as one of them fails, or if they are still pending when ctx is done.
+func (d *Deployer) waitChecks(ctx context.Context, service *model.Service, event *model.PushEvent) error {
+	out := outputFromContext(ctx)
+	ticker := time.NewTicker(checksPollInterval)
+	defer ticker.Stop()
+	reported := make(map[string]string)
+	pending := make(map[string]string)
+	for _, name := range service.RequireChecks {
+		pending[name] = checkPending
+	}
+	for {
+		states, err := d.getChecks(ctx, event)
+		if err != nil && ctx.Err() != nil {
+			return &ChecksError{Sha: event.AfterSha, Checks: pending}
+		}
+		if err != nil {
+			return err
+		}
+		failed := make(map[string]string)
+		pending = make(map[string]string)
+		for _, name := range service.RequireChecks {
+			state, ok := states[name]
+			if !ok {
+				state = checkPending
+			}
+			if reported[name] != state {
+				out.Printf("check %s: %s", name, state)
+				reported[name] = state
+			}
+			switch state {
+			case "success":
+			case checkPending:
+				pending[name] = state
+			default:
+				failed[name] = state
+			}
+		}
+		if len(failed) > 0 {
+			return &ChecksError{Sha: event.AfterSha, Checks: failed}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return &ChecksError{Sha: event.AfterSha, Checks: pending}
+		case <-ticker.C:
+		}
+	}
+}
+
+// getChecks returns the state of every commit status and check run on
+// event.AfterSha by name. A state is "success", "pending", or whatever else
+// GitHub reported, like "failure" or "cancelled".
+func (d *Deployer) getChecks(ctx context.Context, event *model.PushEvent) (map[string]string, error) {
+	states := make(map[string]string)
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		combined, resp, err := d.client.GetCombinedStatus(ctx, event.Owner, event.Repo, event.AfterSha, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get commit status: %w", err)
+		}
+		for _, status := range combined.Statuses {
+			states[status.GetContext()] = status.GetState()
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	runOpts := &github.ListCheckRunsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		runs, resp, err := d.checks.ListCheckRunsForRef(ctx, event.Owner, event.Repo, event.AfterSha, runOpts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list check runs: %w", err)
+		}
+		for _, run := range runs.CheckRuns {
+			states[run.GetName()] = checkRunState(run)
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		runOpts.Page = resp.NextPage
+	}
+	return states, nil
+}
+
+func checkRunState(run *github.CheckRun) string {
+	if run.GetStatus() != "completed" {
+		return checkPending
+	}
+	switch run.GetConclusion() {
+	case "success", "neutral", "skipped":
+		return "success"
+	default:
+		return run.GetConclusion()
+	}
+}
@@ -0,0 +1,83 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/btschwartz12/autodeploy/model"
+)
+
+func getTestChecksHandler(states map[string]string, runs func() []map[string]any) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /repos/example/repo/commits/abc/status", func(w http.ResponseWriter, r *http.Request) {
+		statuses := make([]map[string]any, 0)
+		for name, state := range states {
+			statuses = append(statuses, map[string]any{"context": name, "state": state})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"statuses": statuses})
+	})
+	mux.HandleFunc("GET /repos/example/repo/commits/abc/check-runs", func(w http.ResponseWriter, r *http.Request) {
+		checkRuns := runs()
+		json.NewEncoder(w).Encode(map[string]any{"total_count": len(checkRuns), "check_runs": checkRuns})
+	})
+	return mux
+}
+
+func TestWaitChecks(t *testing.T) {
+	checksPollInterval = 10 * time.Millisecond
+	event := &model.PushEvent{AfterSha: "abc", Owner: "example", Repo: "repo", Trigger: model.TriggerPush}
+	service := &model.Service{RequireChecks: []string{"ci/build", "test"}}
+	assert.True(t, NeedsChecks(service, event))
+
+	polls := 0
+	d := getTestGithubDeployer(t, getTestChecksHandler(
+		map[string]string{"ci/build": "success", "other": "failure"},
+		func() []map[string]any {
+			polls++
+			if polls < 3 {
+				return []map[string]any{{"name": "test", "status": "in_progress"}}
+			}
+			return []map[string]any{{"name": "test", "status": "completed", "conclusion": "success"}}
+		},
+	))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, d.waitChecks(ctx, service, event))
+	assert.Equal(t, 3, polls)
+
+	d = getTestGithubDeployer(t, getTestChecksHandler(
+		map[string]string{"ci/build": "pending"},
+		func() []map[string]any {
+			return []map[string]any{{"name": "test", "status": "completed", "conclusion": "timed_out"}}
+		},
+	))
+	err := d.waitChecks(ctx, service, event)
+	var checksErr *ChecksError
+	assert.True(t, errors.As(err, &checksErr))
+	assert.Equal(t, map[string]string{"test": "timed_out"}, checksErr.Checks)
+
+	// checks that never show up are pending until the timeout
+	d = getTestGithubDeployer(t, getTestChecksHandler(
+		map[string]string{"ci/build": "success"},
+		func() []map[string]any { return []map[string]any{} },
+	))
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = d.waitChecks(ctx, service, event)
+	assert.True(t, errors.As(err, &checksErr))
+	assert.EqualError(t, err, "required checks did not pass on abc: test (pending)")
+}
+
+func TestNeedsChecks(t *testing.T) {
+	service := &model.Service{}
+	assert.False(t, NeedsChecks(service, &model.PushEvent{Trigger: model.TriggerPush}))
+	service.RequireChecks = []string{"ci"}
+	assert.False(t, NeedsChecks(service, &model.PushEvent{Trigger: model.TriggerManual}))
+	assert.False(t, NeedsChecks(service, &model.PushEvent{Trigger: model.TriggerRollback}))
+}
@@ -2,43 +2,169 @@ package deploy
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/google/go-github/v68/github"
 	"go.uber.org/zap"
 
 	"github.com/btschwartz12/autodeploy/model"
 	"github.com/btschwartz12/autodeploy/slack"
+	"github.com/btschwartz12/autodeploy/store"
 )
 
+// ErrTimeout is returned when a deployment does not finish within the
+// service's flow timeout.
+var ErrTimeout = errors.New("deployment timed out")
+
+// ErrInterrupted is returned when a deployment is cut off because autodeploy
+// shuts down. Callers interrupt a deployment by cancelling its context with
+// ErrInterrupted as the cause.
+var ErrInterrupted = errors.New("deployment interrupted")
+
+// interrupted reports whether ctx was cancelled to interrupt the deployment,
+// as opposed to running into a timeout.
+func interrupted(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrInterrupted)
+}
+
 type Deployer struct {
 	logger  *zap.SugaredLogger
 	client  *github.RepositoriesService
+	actions *github.ActionsService
+	checks  *github.ChecksService
+	issues  *github.IssuesService
 	ghToken string
 	slack   *slack.SlackClient
+	history *store.Store
+	active  *activeOutputs
+}
+
+// activeOutputs holds the output of the running deployments by ID.
+type activeOutputs struct {
+	mu      sync.Mutex
+	outputs map[uint64]*Output
 }
 
-func New(logger *zap.SugaredLogger, githubToken string) *Deployer {
+// New creates a Deployer. history may be nil, in which case deployments are
+// not recorded.
+func New(logger *zap.SugaredLogger, githubToken string, history *store.Store) *Deployer {
 	ghClient := github.NewClient(nil).WithAuthToken(githubToken)
 	return &Deployer{
 		logger:  logger,
 		client:  ghClient.Repositories,
+		actions: ghClient.Actions,
+		checks:  ghClient.Checks,
+		issues:  ghClient.Issues,
 		ghToken: githubToken,
+		history: history,
+		active:  &activeOutputs{outputs: make(map[uint64]*Output)},
+	}
+}
+
+// WithToken returns a Deployer like d that uses githubToken. Both share the
+// running deployments, so either one can watch them.
+func (d *Deployer) WithToken(githubToken string) *Deployer {
+	n := New(d.logger, githubToken, d.history)
+	n.active = d.active
+	return n
+}
+
+// Deploy deploys event to service and returns the record of the deployment.
+// The service's flow timeout is applied once the required checks passed.
+func (d *Deployer) Deploy(ctx context.Context, service *model.Service, event *model.PushEvent) (*model.Deployment, error) {
+	p := d.Start(service, event)
+	if err := p.WaitChecks(ctx); err != nil {
+		return p.Finish(ctx, err)
+	}
+	return p.Run(ctx, event)
+}
+
+// Watch returns the output of the deployment with the given ID, or nil if it
+// is not running.
+func (d *Deployer) Watch(id uint64) *Output {
+	d.active.mu.Lock()
+	defer d.active.mu.Unlock()
+	return d.active.outputs[id]
+}
+
+func (d *Deployer) setActive(id uint64, out *Output) {
+	// without a history store there are no ids to watch
+	if id == 0 {
+		return
+	}
+	d.active.mu.Lock()
+	defer d.active.mu.Unlock()
+	if out == nil {
+		delete(d.active.outputs, id)
+	} else {
+		d.active.outputs[id] = out
 	}
 }
 
-func (d *Deployer) Deploy(ctx context.Context, service *model.Service, event *model.PushEvent) error {
+func (d *Deployer) deploy(
+	ctx context.Context,
+	service *model.Service,
+	event *model.PushEvent,
+	record *model.Deployment,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(service.FlowTimeout))
+	defer cancel()
+	err := d.run(ctx, service, event, record)
+	if err != nil && interrupted(ctx) {
+		d.notifyInterrupted(ctx, service, event, record)
+		return fmt.Errorf("%w: %w", ErrInterrupted, err)
+	}
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return err
+}
+
+// notifyInterrupted marks the GitHub deployment of an interrupted deployment
+// as errored, since nobody knows what state the service was left in.
+func (d *Deployer) notifyInterrupted(
+	ctx context.Context,
+	service *model.Service,
+	event *model.PushEvent,
+	record *model.Deployment,
+) {
+	if record.GithubDeploymentID == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	err := d.notifyFinish(ctx, record.GithubDeploymentID, service, event, StateError, "interrupted by shutdown")
+	if err != nil {
+		d.logger.Errorw("failed to notify interruption", "service", service.Name, "error", err)
+	}
+}
+
+func (d *Deployer) run(
+	ctx context.Context,
+	service *model.Service,
+	event *model.PushEvent,
+	record *model.Deployment,
+) error {
 	// make deployment
-	d.logger.Infow("beginning deployment", "service", service.Name)
+	d.logger.Infow("beginning deployment", "service", service.Name, "deployment", record.ID)
 	deploymentID, err := d.notifyBegin(ctx, service, event)
 	if err != nil {
 		return fmt.Errorf("failed to notify: %w", err)
 	}
+	record.GithubDeploymentID = deploymentID
 	// pre-activation
 	d.logger.Infow("pre-activation", "service", service.Name)
-	err = d.pre(ctx, service, event)
+	err = d.runPhase(ctx, record, phasePre, func() error {
+		return d.pre(ctx, service, event)
+	})
+	// manual deployments only know their commits once they are checked out
+	record.BeforeSha = event.BeforeSha
+	record.AfterSha = event.AfterSha
 	if err != nil {
-		notifyErr := d.notifyFinish(ctx, deploymentID, service, event, StateFailure)
+		notifyErr := d.notifyFinish(ctx, deploymentID, service, event, StateFailure, "")
 		if notifyErr != nil {
 			d.logger.Errorw("failed to notify failure", "error", notifyErr)
 		}
@@ -46,42 +172,98 @@ func (d *Deployer) Deploy(ctx context.Context, service *model.Service, event *mo
 	}
 	// activation
 	d.logger.Infow("activation", "service", service.Name)
-	err = d.activate(ctx, service)
+	err = d.runPhase(ctx, record, phaseActivate, func() error {
+		return d.activate(ctx, service)
+	})
 	if err != nil {
-		notifyErr := d.notifyFinish(ctx, deploymentID, service, event, StateFailure)
-		if notifyErr != nil {
-			d.logger.Errorw("failed to notify failure", "error", notifyErr)
-		}
-		return fmt.Errorf("activation failed: %w", err)
+		return d.fail(ctx, deploymentID, service, event, record, fmt.Errorf("activation failed: %w", err))
 	}
 	// post-activation
 	d.logger.Infow("post-activation", "service", service.Name)
-	err = d.post(ctx, service)
+	err = d.runPhase(ctx, record, phasePost, func() error {
+		return d.post(ctx, service)
+	})
 	if err != nil {
-		notifyErr := d.notifyFinish(ctx, deploymentID, service, event, StateFailure)
-		if notifyErr != nil {
-			d.logger.Errorw("failed to notify failure", "error", notifyErr)
-		}
-		return fmt.Errorf("post-activation failed: %w", err)
+		return d.fail(ctx, deploymentID, service, event, record, fmt.Errorf("post-activation failed: %w", err))
 	}
 	// success
-	notifyErr := d.notifyFinish(ctx, deploymentID, service, event, StateSuccess)
+	notifyErr := d.notifyFinish(ctx, deploymentID, service, event, StateSuccess, "")
 	if notifyErr != nil {
 		d.logger.Errorw("failed to notify success", "error", notifyErr)
 	}
+	// workflows
+	if len(service.TriggerWorkflows) > 0 {
+		d.logger.Infow("triggering workflows", "service", service.Name, "workflows", service.TriggerWorkflows)
+		// the deployment is done, so workflows neither count against the flow
+		// timeout nor fail it, but a shutdown still interrupts them
+		flowCtx := ctx
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Duration(service.WorkflowTimeout))
+		defer cancel()
+		stop := context.AfterFunc(flowCtx, func() {
+			if interrupted(flowCtx) {
+				cancel()
+			}
+		})
+		defer stop()
+		err = d.runPhase(ctx, record, phaseWorkflows, func() error {
+			return d.triggerWorkflows(ctx, service, event, record)
+		})
+		if err != nil {
+			d.logger.Errorw("workflows failed", "service", service.Name, "error", err)
+		}
+	}
 	return nil
 }
 
+// fail handles a failed activation or post-activation, rolling back to the
+// previous commit if the service asks for it.
+func (d *Deployer) fail(
+	ctx context.Context,
+	deploymentID int64,
+	service *model.Service,
+	event *model.PushEvent,
+	record *model.Deployment,
+	err error,
+) error {
+	description := ""
+	// a rollback would hold up the shutdown that interrupted the deployment
+	if service.RollbackOnFailure && !interrupted(ctx) {
+		d.logger.Infow("rolling back", "service", service.Name, "sha", event.BeforeSha, "error", err)
+		rollbackErr := d.runPhase(ctx, record, phaseRollback, func() error {
+			return d.rollback(ctx, service, event)
+		})
+		err = &RollbackError{
+			Err:         err,
+			RollbackErr: rollbackErr,
+			Sha:         event.BeforeSha,
+		}
+		if rollbackErr != nil {
+			d.logger.Errorw("rollback failed", "service", service.Name, "error", rollbackErr)
+			description = fmt.Sprintf("rollback to %s failed", shortSha(event.BeforeSha))
+		} else {
+			d.logger.Infow("rolled back", "service", service.Name, "sha", event.BeforeSha)
+			description = fmt.Sprintf("rolled back to %s", shortSha(event.BeforeSha))
+		}
+		// the flow deadline may have passed while rolling back
+		ctx = context.WithoutCancel(ctx)
+	}
+	notifyErr := d.notifyFinish(ctx, deploymentID, service, event, StateFailure, description)
+	if notifyErr != nil {
+		d.logger.Errorw("failed to notify failure", "error", notifyErr)
+	}
+	return err
+}
+
 func (d *Deployer) notifyBegin(
 	ctx context.Context,
 	service *model.Service,
 	event *model.PushEvent,
 ) (int64, error) {
-	deploymentID, err := d.createDeployment(ctx, event)
+	deploymentID, err := d.createDeployment(ctx, service, event)
 	if err != nil {
 		return 0, fmt.Errorf("failed to create deployment: %w", err)
 	}
-	err = d.createDeploymentStatus(ctx, deploymentID, service, event, StatePending)
+	err = d.createDeploymentStatus(ctx, deploymentID, service, event, StatePending, "")
 	if err != nil {
 		return 0, fmt.Errorf("failed to create deployment status: %w", err)
 	}
@@ -95,11 +277,54 @@ func (d *Deployer) notifyFinish(
 	service *model.Service,
 	event *model.PushEvent,
 	state State,
+	description string,
 ) error {
-	err := d.createDeploymentStatus(ctx, deploymentID, service, event, state)
+	err := d.createDeploymentStatus(ctx, deploymentID, service, event, state, description)
 	if err != nil {
 		return fmt.Errorf("failed to create deployment status: %w", err)
 	}
 	d.logger.Infow("created deployment status", "deployment_id", deploymentID, "state", state)
 	return nil
 }
+
+// Supersede records a deployment for event that was skipped in favor of a
+// newer push.
+func (d *Deployer) Supersede(
+	ctx context.Context,
+	service *model.Service,
+	event *model.PushEvent,
+	by *model.PushEvent,
+) error {
+	record := model.NewDeployment(service, event)
+	if err := d.supersede(ctx, service, event, by, record); err != nil {
+		return err
+	}
+	record.FinishedAt = record.StartedAt
+	d.createRecord(record)
+	return nil
+}
+
+// supersede marks record as superseded by the push of by, and creates an
+// inactive GitHub deployment for event.
+func (d *Deployer) supersede(
+	ctx context.Context,
+	service *model.Service,
+	event *model.PushEvent,
+	by *model.PushEvent,
+	record *model.Deployment,
+) error {
+	description := fmt.Sprintf("superseded by %s", shortSha(by.AfterSha))
+	record.State = model.DeploymentSuperseded
+	record.Error = description
+	deploymentID, err := d.createDeployment(ctx, service, event)
+	if err != nil {
+		return fmt.Errorf("failed to create deployment: %w", err)
+	}
+	record.GithubDeploymentID = deploymentID
+	err = d.createDeploymentStatus(ctx, deploymentID, service, event, StateInactive, description)
+	if err != nil {
+		return fmt.Errorf("failed to create deployment status: %w", err)
+	}
+	d.logger.Infow("created superseded deployment", "deployment_id", deploymentID, "service", service.Name)
+	return nil
+}
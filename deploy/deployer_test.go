@@ -0,0 +1,81 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v68/github"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/btschwartz12/autodeploy/model"
+)
+
+func TestDeployInterrupted(t *testing.T) {
+	_, _, dir, shas := getTestRemote(t)
+	sha := shas[0]
+	var mu sync.Mutex
+	states := make([]string, 0)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /repos/example/repo/deployments", func(w http.ResponseWriter, r *http.Request) {
+		var request github.DeploymentRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{"id": 1, "ref": request.GetRef()})
+	})
+	mux.HandleFunc("GET /repos/example/repo/commits/v1", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sha))
+	})
+	mux.HandleFunc("POST /repos/example/repo/deployments/1/statuses", func(w http.ResponseWriter, r *http.Request) {
+		var request github.DeploymentStatusRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		mu.Lock()
+		states = append(states, request.GetState())
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{"id": 1, "state": request.GetState()})
+	})
+	d := getTestGithubDeployer(t, mux)
+
+	service := &model.Service{
+		Name:              "test",
+		Path:              dir,
+		BuildCommand:      "sleep 10",
+		FlowTimeout:       model.Duration(time.Minute),
+		RollbackOnFailure: true,
+	}
+	event := &model.PushEvent{Ref: "v1", Owner: "example", Repo: "repo", Trigger: model.TriggerManual}
+	ctx, interrupt := context.WithCancelCause(context.Background())
+	time.AfterFunc(200*time.Millisecond, func() { interrupt(ErrInterrupted) })
+
+	start := time.Now()
+	record, err := d.Deploy(ctx, service, event)
+	assert.ErrorIs(t, err, ErrInterrupted)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, model.DeploymentInterrupted, record.State)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"pending", "error"}, states)
+}
+
+func TestRollbackInterrupted(t *testing.T) {
+	_, _, dir, shas := getTestRemote(t)
+	d := New(zap.NewNop().Sugar(), "", nil)
+	service := &model.Service{
+		Name:         "test",
+		Path:         dir,
+		BuildCommand: "sleep 10",
+		FlowTimeout:  model.Duration(time.Minute),
+	}
+	event := &model.PushEvent{BeforeSha: shas[0], AfterSha: shas[1]}
+	ctx, interrupt := context.WithCancelCause(context.Background())
+	time.AfterFunc(200*time.Millisecond, func() { interrupt(ErrInterrupted) })
+
+	start := time.Now()
+	assert.Error(t, d.rollback(ctx, service, event))
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
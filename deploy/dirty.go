@@ -0,0 +1,213 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/btschwartz12/autodeploy/model"
+)
+
+// maxDirtyFiles caps how many dirty files a message lists.
+const maxDirtyFiles = 20
+
+// stashRefPrefix is where stashed local changes are kept.
+const stashRefPrefix = "refs/autodeploy/stash/"
+
+// dirtyFile is a local change in the worktree.
+type dirtyFile struct {
+	// path is relative to the repository root
+	path   string
+	status *git.FileStatus
+}
+
+// String formats the change like git status --short does.
+func (f dirtyFile) String() string {
+	return fmt.Sprintf("%c%c %s", f.status.Staging, f.status.Worktree, f.path)
+}
+
+func (f dirtyFile) untracked() bool {
+	return f.status.Worktree == git.Untracked
+}
+
+// cleanWorktree gets local changes out of the way of a deployment, as the
+// service's dirty_worktree policy says. Changes to shared paths don't count.
+func (d *Deployer) cleanWorktree(
+	ctx context.Context,
+	service *model.Service,
+	repo *git.Repository,
+	worktree *git.Worktree,
+) error {
+	files, err := dirtyFiles(service, worktree)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	switch service.DirtyWorktree {
+	case model.DirtyStash:
+		return d.stash(ctx, service, repo, worktree, files)
+	case model.DirtyDiscard:
+		return d.discard(ctx, service, repo, worktree, files)
+	case model.DirtyIgnoreUntracked:
+		files = slices.DeleteFunc(files, dirtyFile.untracked)
+		if len(files) == 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("worktree is not clean: %s", listDirty(files))
+}
+
+// dirtyFiles returns the local changes in the worktree outside the service's
+// shared paths, sorted by path.
+func dirtyFiles(service *model.Service, worktree *git.Worktree) ([]dirtyFile, error) {
+	status, err := worktree.Status()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get worktree status: %w", err)
+	}
+	files := make([]dirtyFile, 0)
+	for path, s := range status {
+		if s.Worktree == git.Unmodified && s.Staging == git.Unmodified {
+			continue
+		}
+		if !service.IsShared(path) {
+			files = append(files, dirtyFile{path: path, status: s})
+		}
+	}
+	slices.SortFunc(files, func(a, b dirtyFile) int {
+		return strings.Compare(a.path, b.path)
+	})
+	return files, nil
+}
+
+func listDirty(files []dirtyFile) string {
+	list := make([]string, 0, min(len(files), maxDirtyFiles))
+	for _, f := range files[:min(len(files), maxDirtyFiles)] {
+		list = append(list, f.String())
+	}
+	if len(files) > maxDirtyFiles {
+		list = append(list, fmt.Sprintf("and %d more", len(files)-maxDirtyFiles))
+	}
+	return strings.Join(list, ", ")
+}
+
+// stash commits the local changes on top of HEAD, keeps the commit under
+// refs/autodeploy/stash/ and resets the worktree back to HEAD.
+func (d *Deployer) stash(
+	ctx context.Context,
+	service *model.Service,
+	repo *git.Repository,
+	worktree *git.Worktree,
+	files []dirtyFile,
+) error {
+	out := outputFromContext(ctx)
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("failed to get HEAD: %w", err)
+	}
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		if f.status.Worktree == git.Deleted {
+			_, err = worktree.Remove(f.path)
+		} else {
+			_, err = worktree.Add(f.path)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to stage %s: %w", f.path, err)
+		}
+		paths = append(paths, f.path)
+	}
+	now := time.Now()
+	hash, err := worktree.Commit("autodeploy: local changes before deploying", &git.CommitOptions{
+		Author: &object.Signature{Name: "autodeploy", Email: "autodeploy@localhost", When: now},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to commit local changes: %w", err)
+	}
+	ref := plumbing.NewHashReference(plumbing.ReferenceName(stashRefPrefix+now.UTC().Format("20060102T150405Z")), hash)
+	if err := repo.Storer.SetReference(ref); err != nil {
+		return fmt.Errorf("failed to save stash ref: %w", err)
+	}
+	err = worktree.Reset(&git.ResetOptions{
+		Mode:   git.HardReset,
+		Commit: head.Hash(),
+		Files:  paths,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to reset worktree: %w", err)
+	}
+	if err := removeUntracked(worktree, files); err != nil {
+		return err
+	}
+	out.Printf("stashed local changes in %s (%s): %s", ref.Name(), shortSha(hash.String()), listDirty(files))
+	d.logger.Warnw("stashed local changes", "service", service.Name, "ref", ref.Name(), "sha", hash.String())
+	return nil
+}
+
+// discard throws away the local changes, except for files that match the
+// service's discard_ignore globs.
+func (d *Deployer) discard(
+	ctx context.Context,
+	service *model.Service,
+	repo *git.Repository,
+	worktree *git.Worktree,
+	files []dirtyFile,
+) error {
+	out := outputFromContext(ctx)
+	files = slices.DeleteFunc(files, func(f dirtyFile) bool {
+		return service.KeepsOnDiscard(f.path)
+	})
+	if len(files) == 0 {
+		return nil
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("failed to get HEAD: %w", err)
+	}
+	tracked := make([]string, 0, len(files))
+	for _, f := range files {
+		if !f.untracked() {
+			tracked = append(tracked, f.path)
+		}
+	}
+	if len(tracked) > 0 {
+		err := worktree.Reset(&git.ResetOptions{
+			Mode:   git.HardReset,
+			Commit: head.Hash(),
+			Files:  tracked,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to reset worktree: %w", err)
+		}
+	}
+	if err := removeUntracked(worktree, files); err != nil {
+		return err
+	}
+	out.Printf("discarded local changes: %s", listDirty(files))
+	d.logger.Warnw("discarded local changes", "service", service.Name, "files", len(files))
+	return nil
+}
+
+func removeUntracked(worktree *git.Worktree, files []dirtyFile) error {
+	errs := make([]error, 0)
+	for _, f := range files {
+		if !f.untracked() {
+			continue
+		}
+		err := os.Remove(filepath.Join(worktree.Filesystem.Root(), filepath.FromSlash(f.path)))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
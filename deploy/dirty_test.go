@@ -0,0 +1,128 @@
+package deploy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/btschwartz12/autodeploy/model"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// getDirtyRepo returns a clone from getTestRemote with a modified tracked
+// file and two untracked ones.
+func getDirtyRepo(t *testing.T) (dir string, repo *git.Repository, worktree *git.Worktree, shas []string) {
+	_, _, dir, shas = getTestRemote(t)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "version"), []byte("hotfix"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("notes"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "app.log"), []byte("log"), 0o644))
+	repo, err := git.PlainOpen(dir)
+	assert.NoError(t, err)
+	worktree, err = repo.Worktree()
+	assert.NoError(t, err)
+	return dir, repo, worktree, shas
+}
+
+func TestCleanWorktreeFail(t *testing.T) {
+	dir, repo, worktree, _ := getDirtyRepo(t)
+	deployer := New(zap.NewNop().Sugar(), "", nil)
+	service := &model.Service{Name: "test", Path: dir, DirtyWorktree: model.DirtyFail}
+	err := deployer.cleanWorktree(context.Background(), service, repo, worktree)
+	assert.EqualError(t, err, "worktree is not clean: ?? app.log, ?? notes.txt,  M version")
+
+	service.DirtyWorktree = model.DirtyIgnoreUntracked
+	err = deployer.cleanWorktree(context.Background(), service, repo, worktree)
+	assert.EqualError(t, err, "worktree is not clean:  M version")
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "version"), []byte("1"), 0o644))
+	assert.NoError(t, deployer.cleanWorktree(context.Background(), service, repo, worktree))
+}
+
+func TestPreIgnoreUntracked(t *testing.T) {
+	dir, _, _, shas := getDirtyRepo(t)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "version"), []byte("1"), 0o644))
+	deployer := New(zap.NewNop().Sugar(), "", nil)
+	service := &model.Service{Name: "test", Path: dir, DirtyWorktree: model.DirtyIgnoreUntracked}
+
+	event := &model.PushEvent{BeforeSha: shas[0], AfterSha: shas[1], Trigger: model.TriggerPush}
+	assert.NoError(t, deployer.pre(context.Background(), service, event))
+	assert.Equal(t, "2", readVersion(t, dir))
+	assert.FileExists(t, filepath.Join(dir, "notes.txt"))
+	assert.FileExists(t, filepath.Join(dir, "app.log"))
+
+	event = &model.PushEvent{Ref: "v1", Trigger: model.TriggerManual}
+	assert.NoError(t, deployer.pre(context.Background(), service, event))
+	assert.Equal(t, "1", readVersion(t, dir))
+	assert.FileExists(t, filepath.Join(dir, "notes.txt"))
+
+	service.SyncPolicy = model.SyncForce
+	event = &model.PushEvent{BeforeSha: shas[0], AfterSha: shas[1], Trigger: model.TriggerPush}
+	assert.NoError(t, deployer.pre(context.Background(), service, event))
+	assert.Equal(t, "2", readVersion(t, dir))
+	assert.FileExists(t, filepath.Join(dir, "notes.txt"))
+}
+
+func TestCleanWorktreeDiscard(t *testing.T) {
+	dir, repo, worktree, _ := getDirtyRepo(t)
+	deployer := New(zap.NewNop().Sugar(), "", nil)
+	service := &model.Service{
+		Name:          "test",
+		Path:          dir,
+		DirtyWorktree: model.DirtyDiscard,
+		DiscardIgnore: []string{"*.log"},
+	}
+	assert.NoError(t, deployer.cleanWorktree(context.Background(), service, repo, worktree))
+	assert.Equal(t, "1", readVersion(t, dir))
+	assert.NoFileExists(t, filepath.Join(dir, "notes.txt"))
+	assert.FileExists(t, filepath.Join(dir, "app.log"))
+}
+
+func TestCleanWorktreeStash(t *testing.T) {
+	dir, repo, worktree, shas := getDirtyRepo(t)
+	deployer := New(zap.NewNop().Sugar(), "", nil)
+	service := &model.Service{Name: "test", Path: dir, DirtyWorktree: model.DirtyStash}
+	out := newOutput(maxOutputSize)
+	ctx := withOutput(context.Background(), out)
+	assert.NoError(t, deployer.cleanWorktree(ctx, service, repo, worktree))
+	assert.Equal(t, "1", readVersion(t, dir))
+	assert.NoFileExists(t, filepath.Join(dir, "notes.txt"))
+	status, err := worktree.Status()
+	assert.NoError(t, err)
+	assert.True(t, status.IsClean())
+	head, err := repo.Head()
+	assert.NoError(t, err)
+	assert.Equal(t, shas[0], head.Hash().String())
+
+	// the changes are kept in a commit on top of HEAD
+	refs, err := repo.References()
+	assert.NoError(t, err)
+	var stash *plumbing.Reference
+	refs.ForEach(func(ref *plumbing.Reference) error {
+		if strings.HasPrefix(ref.Name().String(), stashRefPrefix) {
+			stash = ref
+		}
+		return nil
+	})
+	assert.NotNil(t, stash)
+	commit, err := repo.CommitObject(stash.Hash())
+	assert.NoError(t, err)
+	assert.Equal(t, shas[0], commit.ParentHashes[0].String())
+	file, err := commit.File("version")
+	assert.NoError(t, err)
+	contents, err := file.Contents()
+	assert.NoError(t, err)
+	assert.Equal(t, "hotfix", contents)
+	_, err = commit.File("notes.txt")
+	assert.NoError(t, err)
+	assert.Contains(t, lineTexts(out.Lines())[0], stash.Name().String())
+
+	// and the deployment goes ahead
+	event := &model.PushEvent{BeforeSha: shas[0], AfterSha: shas[1], Trigger: model.TriggerPush}
+	assert.NoError(t, deployer.pull(context.Background(), service, event))
+	assert.Equal(t, "2", readVersion(t, dir))
+}
@@ -12,23 +12,45 @@ import (
 type State string
 
 const (
-	StatePending State = "pending"
-	StateSuccess State = "success"
-	StateFailure State = "failure"
+	StatePending  State = "pending"
+	StateSuccess  State = "success"
+	StateFailure  State = "failure"
+	StateInactive State = "inactive"
+	StateError    State = "error"
 )
 
 func (d *Deployer) createDeployment(
 	ctx context.Context,
+	service *model.Service,
 	event *model.PushEvent,
 ) (int64, error) {
-	deployment, resp, err := d.client.CreateDeployment(
-		ctx,
-		event.Owner,
-		event.Repo,
-		&github.DeploymentRequest{
-			Ref: &event.Ref,
-		},
-	)
+	request := &github.DeploymentRequest{
+		Ref:         &event.Ref,
+		Environment: &service.Environment,
+	}
+	if event.Release != "" {
+		request.Description = github.Ptr("release " + event.Release)
+	}
+	switch event.Trigger {
+	case model.TriggerPullRequest:
+		// previews deploy whatever the pull request is at, so GitHub must
+		// neither merge the default branch into it nor wait for its checks
+		request.AutoMerge = github.Ptr(false)
+		request.RequiredContexts = &[]string{}
+		request.TransientEnvironment = github.Ptr(true)
+	case model.TriggerManual, model.TriggerRollback, model.TriggerTag, model.TriggerRelease:
+		// these deploy a given commit, which the branch may have moved past,
+		// and GitHub must not refuse them over failing checks, since that
+		// is when a rollback is needed most
+		sha, err := d.resolveSha(ctx, event)
+		if err != nil {
+			return 0, err
+		}
+		request.Ref = &sha
+		request.AutoMerge = github.Ptr(false)
+		request.RequiredContexts = &[]string{}
+	}
+	deployment, resp, err := d.client.CreateDeployment(ctx, event.Owner, event.Repo, request)
 	if err != nil {
 		return 0, fmt.Errorf("failed to create deployment: %w", err)
 	}
@@ -38,18 +60,34 @@ func (d *Deployer) createDeployment(
 	if deployment.Ref == nil {
 		return 0, fmt.Errorf("ref not set in deployment")
 	}
-	if *deployment.Ref != event.Ref {
+	if *deployment.Ref != *request.Ref {
 		return 0, fmt.Errorf("unexpected ref in deployment: %s", *deployment.Ref)
 	}
 	return deployment.GetID(), nil
 }
 
+// resolveSha returns the commit event deploys, resolving its ref on GitHub
+// if it is not known yet. event.AfterSha is filled in, so that the commit
+// that is checked out is the one the GitHub deployment is for.
+func (d *Deployer) resolveSha(ctx context.Context, event *model.PushEvent) (string, error) {
+	if event.AfterSha != "" {
+		return event.AfterSha, nil
+	}
+	sha, _, err := d.client.GetCommitSHA1(ctx, event.Owner, event.Repo, event.Ref, "")
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", event.Ref, err)
+	}
+	event.AfterSha = sha
+	return sha, nil
+}
+
 func (d *Deployer) createDeploymentStatus(
 	ctx context.Context,
 	deploymentID int64,
 	service *model.Service,
 	event *model.PushEvent,
 	state State,
+	description string,
 ) error {
 	stateStr := string(state)
 	status, resp, err := d.client.CreateDeploymentStatus(
@@ -60,6 +98,7 @@ func (d *Deployer) createDeploymentStatus(
 		&github.DeploymentStatusRequest{
 			State:          &stateStr,
 			EnvironmentURL: &service.HealthcheckURL,
+			Description:    &description,
 		},
 	)
 	if err != nil {
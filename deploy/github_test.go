@@ -2,11 +2,14 @@ package deploy
 
 import (
 	"context"
+	"encoding/json"
+	"net/http"
 	"os"
 	"strings"
 	"testing"
 
 	"github.com/btschwartz12/autodeploy/model"
+	"github.com/google/go-github/v68/github"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 )
@@ -24,6 +27,7 @@ func getTestEvent(repo string) *model.PushEvent {
 func getTestService() *model.Service {
 	return &model.Service{
 		HealthcheckURL: "https://example.com",
+		Environment:    "test",
 	}
 }
 
@@ -34,10 +38,10 @@ func TestCreateDeploymentPending(t *testing.T) {
 	assert.NoError(t, err)
 	repo := string(repoB)
 
-	deployer := New(zap.NewNop().Sugar(), string(token))
+	deployer := New(zap.NewNop().Sugar(), string(token), nil)
 	assert.NoError(t, err)
 
-	id, err := deployer.createDeployment(context.Background(), getTestEvent(repo))
+	id, err := deployer.createDeployment(context.Background(), getTestService(), getTestEvent(repo))
 	assert.NoError(t, err)
 	assert.NotZero(t, id)
 
@@ -47,6 +51,7 @@ func TestCreateDeploymentPending(t *testing.T) {
 		getTestService(),
 		getTestEvent(repo),
 		StatePending,
+		"",
 	)
 	assert.NoError(t, err)
 }
@@ -59,10 +64,10 @@ func TestCreateDeploymentSuccess(t *testing.T) {
 	assert.NoError(t, err)
 	repo := string(repoB)
 
-	deployer := New(zap.NewNop().Sugar(), string(token))
+	deployer := New(zap.NewNop().Sugar(), string(token), nil)
 	assert.NoError(t, err)
 
-	id, err := deployer.createDeployment(context.Background(), getTestEvent(repo))
+	id, err := deployer.createDeployment(context.Background(), getTestService(), getTestEvent(repo))
 	assert.NoError(t, err)
 	assert.NotZero(t, id)
 
@@ -72,6 +77,7 @@ func TestCreateDeploymentSuccess(t *testing.T) {
 		getTestService(),
 		getTestEvent(repo),
 		StatePending,
+		"",
 	)
 	assert.NoError(t, err)
 
@@ -81,6 +87,7 @@ func TestCreateDeploymentSuccess(t *testing.T) {
 		getTestService(),
 		getTestEvent(repo),
 		StateSuccess,
+		"",
 	)
 	assert.NoError(t, err)
 }
@@ -93,10 +100,10 @@ func TestCreateDeploymentFailure(t *testing.T) {
 	assert.NoError(t, err)
 	repo := string(repoB)
 
-	deployer := New(zap.NewNop().Sugar(), string(token))
+	deployer := New(zap.NewNop().Sugar(), string(token), nil)
 	assert.NoError(t, err)
 
-	id, err := deployer.createDeployment(context.Background(), getTestEvent(repo))
+	id, err := deployer.createDeployment(context.Background(), getTestService(), getTestEvent(repo))
 	assert.NoError(t, err)
 	assert.NotZero(t, id)
 
@@ -106,6 +113,7 @@ func TestCreateDeploymentFailure(t *testing.T) {
 		getTestService(),
 		getTestEvent(repo),
 		StatePending,
+		"",
 	)
 	assert.NoError(t, err)
 
@@ -115,6 +123,45 @@ func TestCreateDeploymentFailure(t *testing.T) {
 		getTestService(),
 		getTestEvent(repo),
 		StateFailure,
+		"",
 	)
 	assert.NoError(t, err)
 }
+
+func TestPinnedDeployment(t *testing.T) {
+	requests := make([]github.DeploymentRequest, 0)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /repos/example/repo/commits/refs/tags/v1", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("abc"))
+	})
+	mux.HandleFunc("POST /repos/example/repo/deployments", func(w http.ResponseWriter, r *http.Request) {
+		var request github.DeploymentRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		requests = append(requests, request)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{"id": 1, "ref": request.GetRef()})
+	})
+	d := getTestGithubDeployer(t, mux)
+
+	// a push deploys its branch
+	event := &model.PushEvent{Ref: "refs/heads/main", AfterSha: "def", Owner: "example", Repo: "repo", Trigger: model.TriggerPush}
+	_, err := d.createDeployment(context.Background(), getTestService(), event)
+	assert.NoError(t, err)
+	assert.Equal(t, "refs/heads/main", requests[0].GetRef())
+	assert.Nil(t, requests[0].AutoMerge)
+
+	// a rollback deploys its commit, whatever the branch and its checks are at
+	event = &model.PushEvent{Ref: "refs/heads/main", AfterSha: "def", Owner: "example", Repo: "repo", Trigger: model.TriggerRollback}
+	_, err = d.createDeployment(context.Background(), getTestService(), event)
+	assert.NoError(t, err)
+	assert.Equal(t, "def", requests[1].GetRef())
+	assert.False(t, requests[1].GetAutoMerge())
+	assert.Equal(t, []string{}, requests[1].GetRequiredContexts())
+
+	// a tag is resolved first
+	event = &model.PushEvent{Ref: "refs/tags/v1", Owner: "example", Repo: "repo", Trigger: model.TriggerTag}
+	_, err = d.createDeployment(context.Background(), getTestService(), event)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", requests[2].GetRef())
+	assert.Equal(t, "abc", event.AfterSha)
+}
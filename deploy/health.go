@@ -0,0 +1,92 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/btschwartz12/autodeploy/model"
+)
+
+// only this much of the response body is inspected by body_contains / body_regex
+const maxHealthcheckBody = 1 << 20
+
+// waitHealthy polls the service's healthcheck URL until it has passed the
+// configured number of consecutive times, or until ctx is done.
+func (d *Deployer) waitHealthy(ctx context.Context, service *model.Service) error {
+	hc := service.Healthcheck
+	out := outputFromContext(ctx)
+	successes := 0
+	attempts := 0
+	var lastErr error
+	for {
+		attempts++
+		err := probe(ctx, service.HealthcheckURL, &hc)
+		if err == nil {
+			successes++
+			out.Printf("healthcheck %s: passed (%d/%d)", service.HealthcheckURL, successes, hc.Successes)
+			d.logger.Infow("healthcheck passed", "service", service.Name, "successes", successes, "required", hc.Successes)
+			if successes >= hc.Successes {
+				return nil
+			}
+		} else {
+			successes = 0
+			// a probe cut short by ctx says nothing about the service
+			if lastErr == nil || ctx.Err() == nil {
+				lastErr = err
+			}
+			out.Printf("healthcheck %s: %s", service.HealthcheckURL, err)
+			d.logger.Infow("healthcheck failed", "service", service.Name, "attempt", attempts, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			if lastErr == nil {
+				lastErr = ctx.Err()
+			}
+			return fmt.Errorf("healthcheck did not pass after %d attempts: %w", attempts, lastErr)
+		case <-time.After(time.Duration(hc.Interval)):
+		}
+	}
+}
+
+func probe(ctx context.Context, url string, hc *model.Healthcheck) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(hc.Timeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if !slices.Contains(hc.ExpectedStatus, resp.StatusCode) {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	if hc.BodyContains == "" && hc.BodyRegex == "" {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthcheckBody))
+	if err != nil {
+		return fmt.Errorf("failed to read body: %w", err)
+	}
+	if hc.BodyContains != "" && !strings.Contains(string(body), hc.BodyContains) {
+		return fmt.Errorf("body does not contain %q", hc.BodyContains)
+	}
+	if hc.BodyRegex != "" {
+		re, err := regexp.Compile(hc.BodyRegex)
+		if err != nil {
+			return fmt.Errorf("invalid body_regex: %w", err)
+		}
+		if !re.Match(body) {
+			return fmt.Errorf("body does not match %q", hc.BodyRegex)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package deploy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/btschwartz12/autodeploy/model"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func getHealthcheckService(url string) *model.Service {
+	return &model.Service{
+		Name:           "test",
+		HealthcheckURL: url,
+		Healthcheck: model.Healthcheck{
+			ExpectedStatus: []int{http.StatusOK},
+			Interval:       model.Duration(10 * time.Millisecond),
+			Timeout:        model.Duration(time.Second),
+			Successes:      1,
+		},
+	}
+}
+
+func TestWaitHealthy(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fail the first two probes, then become healthy
+		if calls.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer srv.Close()
+
+	service := getHealthcheckService(srv.URL)
+	service.Healthcheck.Successes = 2
+	service.Healthcheck.BodyContains = `"ok"`
+	service.Healthcheck.BodyRegex = `"status":\s*"ok"`
+
+	deployer := New(zap.NewNop().Sugar(), "", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := deployer.waitHealthy(ctx, service)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(4), calls.Load())
+}
+
+func TestWaitHealthyTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("starting"))
+	}))
+	defer srv.Close()
+
+	service := getHealthcheckService(srv.URL)
+	service.Healthcheck.BodyContains = "ready"
+
+	deployer := New(zap.NewNop().Sugar(), "", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := deployer.waitHealthy(ctx, service)
+	assert.Error(t, err)
+	assert.ErrorContains(t, err, `body does not contain "ready"`)
+}
+
+func TestProbeStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	hc := getHealthcheckService(srv.URL).Healthcheck
+	err := probe(context.Background(), srv.URL, &hc)
+	assert.ErrorContains(t, err, "unexpected status code: 204")
+
+	hc.ExpectedStatus = []int{http.StatusOK, http.StatusNoContent}
+	err = probe(context.Background(), srv.URL, &hc)
+	assert.NoError(t, err)
+}
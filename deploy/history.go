@@ -0,0 +1,87 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/btschwartz12/autodeploy/model"
+)
+
+const (
+	phaseChecks    = "checks"
+	phasePre       = "pre"
+	phaseActivate  = "activate"
+	phasePost      = "post"
+	phaseRollback  = "rollback"
+	phaseWorkflows = "workflows"
+)
+
+// runPhase runs fn as the named phase of record, saving its timings and the
+// output collected so far.
+func (d *Deployer) runPhase(ctx context.Context, record *model.Deployment, name string, fn func() error) error {
+	record.Phases = append(record.Phases, model.Phase{
+		Name:      name,
+		StartedAt: time.Now(),
+	})
+	d.saveRecord(record)
+	out := outputFromContext(ctx)
+	out.Phasef("%s started", name)
+	err := fn()
+	phase := &record.Phases[len(record.Phases)-1]
+	phase.FinishedAt = time.Now()
+	if err != nil {
+		phase.Error = err.Error()
+		out.Phasef("%s failed: %s", name, err)
+	} else {
+		out.Phasef("%s finished", name)
+	}
+	record.Output = out.Lines()
+	d.saveRecord(record)
+	return err
+}
+
+func (d *Deployer) finishRecord(ctx context.Context, record *model.Deployment, err error) {
+	record.FinishedAt = time.Now()
+	var rollbackErr *RollbackError
+	var checksErr *ChecksError
+	switch {
+	case errors.Is(err, ErrInterrupted):
+		record.State = model.DeploymentInterrupted
+	case errors.As(err, &rollbackErr) && rollbackErr.RollbackErr == nil:
+		record.State = model.DeploymentRolledBack
+	case errors.As(err, &checksErr):
+		record.State = model.DeploymentChecksFailed
+	case errors.Is(err, ErrTimeout):
+		record.State = model.DeploymentTimeout
+	case err != nil:
+		record.State = model.DeploymentFailure
+	default:
+		record.State = model.DeploymentSuccess
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	out := outputFromContext(ctx)
+	out.Phasef("deployment finished: %s", record.State)
+	record.Output = out.Lines()
+	d.saveRecord(record)
+}
+
+func (d *Deployer) createRecord(record *model.Deployment) {
+	if d.history == nil {
+		return
+	}
+	if err := d.history.CreateDeployment(record); err != nil {
+		d.logger.Errorw("failed to save deployment record", "service", record.Service, "error", err)
+	}
+}
+
+func (d *Deployer) saveRecord(record *model.Deployment) {
+	if d.history == nil {
+		return
+	}
+	if err := d.history.UpdateDeployment(record); err != nil {
+		d.logger.Errorw("failed to save deployment record", "service", record.Service, "id", record.ID, "error", err)
+	}
+}
@@ -0,0 +1,201 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/btschwartz12/autodeploy/model"
+)
+
+const (
+	// maxOutputSize caps how much command output is kept per deployment.
+	// Once it is reached, the oldest lines are dropped.
+	maxOutputSize = 1 << 20
+	// maxLineSize caps a single line of output
+	maxLineSize = 16 << 10
+)
+
+type outputKey struct{}
+
+// subscriberBuffer is how many lines a live subscriber may fall behind
+// before it is disconnected
+const subscriberBuffer = 256
+
+// Output collects the timestamped output of the commands run during a
+// deployment, and fans it out to live subscribers. A nil *Output discards
+// everything written to it.
+type Output struct {
+	mu          sync.Mutex
+	lines       []model.OutputLine
+	size        int
+	limit       int
+	dropped     int
+	closed      bool
+	subscribers map[chan model.OutputLine]struct{}
+}
+
+func newOutput(limit int) *Output {
+	return &Output{
+		lines:       make([]model.OutputLine, 0),
+		limit:       limit,
+		subscribers: make(map[chan model.OutputLine]struct{}),
+	}
+}
+
+func withOutput(ctx context.Context, out *Output) context.Context {
+	return context.WithValue(ctx, outputKey{}, out)
+}
+
+func outputFromContext(ctx context.Context) *Output {
+	out, _ := ctx.Value(outputKey{}).(*Output)
+	return out
+}
+
+func (o *Output) Printf(format string, args ...any) {
+	if o == nil {
+		return
+	}
+	o.add(model.OutputKindOutput, fmt.Sprintf(format, args...))
+}
+
+// Phasef notes a phase transition.
+func (o *Output) Phasef(format string, args ...any) {
+	if o == nil {
+		return
+	}
+	o.add(model.OutputKindPhase, fmt.Sprintf(format, args...))
+}
+
+// Lines returns the lines collected so far, starting with a truncation
+// marker if older lines had to be dropped.
+func (o *Output) Lines() []model.OutputLine {
+	if o == nil {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.linesLocked()
+}
+
+// Subscribe returns the lines collected so far and a channel that receives
+// every line added after that. The channel is closed when the deployment
+// finishes, or if the subscriber falls too far behind. cancel must be called
+// once the subscriber is done.
+func (o *Output) Subscribe() (replay []model.OutputLine, lines <-chan model.OutputLine, cancel func()) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	ch := make(chan model.OutputLine, subscriberBuffer)
+	if o.closed {
+		close(ch)
+		return o.linesLocked(), ch, func() {}
+	}
+	o.subscribers[ch] = struct{}{}
+	cancel = func() {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		if _, ok := o.subscribers[ch]; ok {
+			delete(o.subscribers, ch)
+			close(ch)
+		}
+	}
+	return o.linesLocked(), ch, cancel
+}
+
+// Close disconnects all subscribers. Lines added afterwards are still kept.
+func (o *Output) Close() {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+	for ch := range o.subscribers {
+		delete(o.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (o *Output) linesLocked() []model.OutputLine {
+	lines := make([]model.OutputLine, 0, len(o.lines)+1)
+	if o.dropped > 0 {
+		lines = append(lines, model.OutputLine{
+			Time: o.lines[0].Time,
+			Kind: model.OutputKindOutput,
+			Text: fmt.Sprintf("[%d earlier bytes truncated]", o.dropped),
+		})
+	}
+	return append(lines, o.lines...)
+}
+
+// Writer returns a writer that adds each line written to it to o. It must be
+// closed to flush a trailing line without a newline. Writers are not safe for
+// concurrent use, so stdout and stderr of a command each need their own.
+func (o *Output) Writer() io.WriteCloser {
+	return &lineWriter{out: o}
+}
+
+func (o *Output) add(kind string, text string) {
+	if len(text) > maxLineSize {
+		text = text[:maxLineSize] + " [line truncated]"
+	}
+	line := model.OutputLine{
+		Time: time.Now(),
+		Kind: kind,
+		Text: text,
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.lines = append(o.lines, line)
+	for ch := range o.subscribers {
+		select {
+		case ch <- line:
+		default:
+			delete(o.subscribers, ch)
+			close(ch)
+		}
+	}
+	o.size += len(text)
+	for o.size > o.limit && len(o.lines) > 1 {
+		o.size -= len(o.lines[0].Text)
+		o.dropped += len(o.lines[0].Text)
+		o.lines = o.lines[1:]
+	}
+}
+
+type lineWriter struct {
+	out *Output
+	buf bytes.Buffer
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	if w.out == nil {
+		return len(p), nil
+	}
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		line := w.buf.Next(i + 1)
+		w.out.add(model.OutputKindOutput, string(bytes.TrimRight(line, "\r\n")))
+	}
+	// don't let a very long line without a newline grow the buffer forever
+	if w.buf.Len() > maxLineSize {
+		w.out.add(model.OutputKindOutput, w.buf.String())
+		w.buf.Reset()
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) Close() error {
+	if w.out != nil && w.buf.Len() > 0 {
+		w.out.add(model.OutputKindOutput, w.buf.String())
+		w.buf.Reset()
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/btschwartz12/autodeploy/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func lineTexts(lines []model.OutputLine) []string {
+	texts := make([]string, len(lines))
+	for i, l := range lines {
+		texts[i] = l.Text
+	}
+	return texts
+}
+
+func TestRunCommandOutput(t *testing.T) {
+	out := newOutput(maxOutputSize)
+	ctx := withOutput(context.Background(), out)
+	service := &model.Service{Name: "test", Path: t.TempDir()}
+
+	err := runCommand(ctx, service, true, "sh", "-c", "echo hello; echo oops >&2; printf partial")
+	assert.NoError(t, err)
+	texts := lineTexts(out.Lines())
+	assert.Equal(t, "$ sh -c echo hello; echo oops >&2; printf partial", texts[0])
+	assert.ElementsMatch(t, []string{"hello", "oops", "partial"}, texts[1:])
+
+	err = runCommand(ctx, service, true, "sh", "-c", "echo broken >&2; exit 3")
+	assert.ErrorContains(t, err, "broken")
+	texts = lineTexts(out.Lines())
+	assert.Equal(t, []string{"broken", "command failed: exit status 3"}, texts[len(texts)-2:])
+
+	// output is optional
+	assert.NoError(t, runCommand(context.Background(), service, true, "true"))
+}
+
+func TestOutputTruncation(t *testing.T) {
+	out := newOutput(100)
+	w := out.Writer()
+	for i := range 20 {
+		fmt.Fprintf(w, "line %02d\n", i)
+	}
+	w.Close()
+
+	// each line is 7 bytes, so only the last 14 fit
+	texts := lineTexts(out.Lines())
+	assert.Len(t, texts, 15)
+	assert.Equal(t, "[42 earlier bytes truncated]", texts[0])
+	assert.Equal(t, "line 06", texts[1])
+	assert.Equal(t, "line 19", texts[14])
+
+	out.Printf("%s", strings.Repeat("x", maxLineSize+1))
+	texts = lineTexts(out.Lines())
+	assert.True(t, strings.HasSuffix(texts[len(texts)-1], "x [line truncated]"))
+}
+
+func TestOutputSubscribe(t *testing.T) {
+	out := newOutput(maxOutputSize)
+	out.Phasef("pre started")
+
+	replay, lines, cancel := out.Subscribe()
+	defer cancel()
+	assert.Equal(t, []string{"pre started"}, lineTexts(replay))
+	assert.Equal(t, model.OutputKindPhase, replay[0].Kind)
+
+	out.Printf("building")
+	line := <-lines
+	assert.Equal(t, "building", line.Text)
+	assert.Equal(t, model.OutputKindOutput, line.Kind)
+
+	out.Close()
+	_, ok := <-lines
+	assert.False(t, ok)
+
+	// late subscribers get everything and a closed channel
+	replay, lines, _ = out.Subscribe()
+	assert.Equal(t, []string{"pre started", "building"}, lineTexts(replay))
+	_, ok = <-lines
+	assert.False(t, ok)
+}
+
+func TestOutputSlowSubscriber(t *testing.T) {
+	out := newOutput(maxOutputSize)
+	_, lines, cancel := out.Subscribe()
+	for i := range subscriberBuffer + 1 {
+		out.Printf("line %d", i)
+	}
+	for range subscriberBuffer {
+		<-lines
+	}
+	_, ok := <-lines
+	assert.False(t, ok)
+	// cancelling after being dropped is fine
+	cancel()
+}
+
+func TestRunCommandEnv(t *testing.T) {
+	out := newOutput(maxOutputSize)
+	ctx := withOutput(context.Background(), out)
+	service := &model.Service{Path: t.TempDir(), Env: map[string]string{"PREVIEW_PORT": "9001"}}
+
+	assert.NoError(t, runCommand(ctx, service, true, "sh", "-c", "echo $PREVIEW_PORT"))
+	assert.Equal(t, "9001", lineTexts(out.Lines())[1])
+
+	assert.Equal(t, []string{"docker", "compose", "up"}, composeCommand(&model.Service{}, "up"))
+	service.ComposeProject = "web-pr-1"
+	assert.Equal(t, []string{"docker", "compose", "--project-name", "web-pr-1", "up"}, composeCommand(service, "up"))
+}
@@ -0,0 +1,82 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/btschwartz12/autodeploy/model"
+)
+
+// Pending is a deployment that was recorded by Start but has not run yet. Its
+// required checks can be waited for before it gets its turn, so that they
+// don't hold up other deployments of the same worktree. It ends with Run,
+// Finish or Supersede.
+type Pending struct {
+	d       *Deployer
+	service *model.Service
+	event   *model.PushEvent
+	record  *model.Deployment
+	out     *Output
+}
+
+// Start records a new deployment of event to service.
+func (d *Deployer) Start(service *model.Service, event *model.PushEvent) *Pending {
+	record := model.NewDeployment(service, event)
+	d.createRecord(record)
+	out := newOutput(maxOutputSize)
+	d.setActive(record.ID, out)
+	return &Pending{d: d, service: service, event: event, record: record, out: out}
+}
+
+// WaitChecks waits for the service's required checks on the pushed commit, if
+// it has any. They don't count against the flow timeout.
+func (p *Pending) WaitChecks(ctx context.Context) error {
+	if !NeedsChecks(p.service, p.event) {
+		return nil
+	}
+	ctx = withOutput(ctx, p.out)
+	p.d.logger.Infow("waiting for checks", "service", p.service.Name, "sha", p.event.AfterSha, "checks", p.service.RequireChecks)
+	err := p.d.runPhase(ctx, p.record, phaseChecks, func() error {
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(p.service.ChecksTimeout))
+		defer cancel()
+		return p.d.waitChecks(ctx, p.service, p.event)
+	})
+	if err != nil && interrupted(ctx) {
+		return fmt.Errorf("%w: %w", ErrInterrupted, err)
+	}
+	return err
+}
+
+// Run deploys event and finishes the deployment. Earlier pushes that were
+// never deployed may have been merged into event since Start.
+func (p *Pending) Run(ctx context.Context, event *model.PushEvent) (*model.Deployment, error) {
+	p.event = event
+	p.record.BeforeSha = event.BeforeSha
+	p.record.Commits = event.Commits
+	return p.Finish(ctx, p.d.deploy(withOutput(ctx, p.out), p.service, event, p.record))
+}
+
+// Finish records how the deployment ended, e.g. with the error of WaitChecks,
+// and returns its record along with err.
+func (p *Pending) Finish(ctx context.Context, err error) (*model.Deployment, error) {
+	p.d.finishRecord(withOutput(ctx, p.out), p.record, err)
+	p.close()
+	return p.record, err
+}
+
+// Supersede finishes the deployment without running it, since the push of by
+// is deployed instead.
+func (p *Pending) Supersede(ctx context.Context, by *model.PushEvent) error {
+	defer p.close()
+	// the record is superseded even if GitHub can't be told
+	err := p.d.supersede(ctx, p.service, p.event, by, p.record)
+	p.record.FinishedAt = time.Now()
+	p.d.saveRecord(p.record)
+	return err
+}
+
+func (p *Pending) close() {
+	p.out.Close()
+	p.d.setActive(p.record.ID, nil)
+}
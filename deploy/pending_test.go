@@ -0,0 +1,54 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/btschwartz12/autodeploy/model"
+	"github.com/btschwartz12/autodeploy/store"
+)
+
+func TestPendingChecks(t *testing.T) {
+	checksPollInterval = 10 * time.Millisecond
+	event := &model.PushEvent{AfterSha: "abc", Owner: "example", Repo: "repo", Trigger: model.TriggerPush}
+	service := &model.Service{Name: "test", RequireChecks: []string{"test"}, ChecksTimeout: model.Duration(5 * time.Second)}
+	d := getTestGithubDeployer(t, getTestChecksHandler(nil, func() []map[string]any {
+		return []map[string]any{{"name": "test", "status": "completed", "conclusion": "failure"}}
+	}))
+	history, err := store.New(filepath.Join(t.TempDir(), "autodeploy.db"))
+	assert.NoError(t, err)
+	defer history.Close()
+	d.history = history
+
+	p := d.Start(service, event)
+	assert.NotNil(t, d.Watch(p.record.ID))
+	err = p.WaitChecks(context.Background())
+	var checksErr *ChecksError
+	assert.True(t, errors.As(err, &checksErr))
+
+	record, err := p.Finish(context.Background(), err)
+	assert.Error(t, err)
+	assert.Equal(t, model.DeploymentChecksFailed, record.State)
+	assert.Nil(t, d.Watch(record.ID))
+	saved, err := history.GetDeployment(record.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, model.DeploymentChecksFailed, saved.State)
+
+	// the wait is interrupted along with the deployments
+	p = d.Start(service, event)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(ErrInterrupted)
+	assert.ErrorIs(t, p.WaitChecks(ctx), ErrInterrupted)
+	p.Finish(ctx, nil)
+
+	// manual deployments don't wait
+	event.Trigger = model.TriggerManual
+	p = d.Start(service, event)
+	assert.NoError(t, p.WaitChecks(ctx))
+	p.Finish(ctx, nil)
+}
@@ -3,16 +3,17 @@ package deploy
 import (
 	"context"
 	"fmt"
-	"time"
+	"strings"
 
 	"github.com/btschwartz12/autodeploy/model"
 )
 
-const sleepTime = 10 * time.Second
-
 func (d *Deployer) post(ctx context.Context, service *model.Service) error {
-	d.logger.Infow("sleeping", "service", service.Name, "duration", sleepTime)
-	time.Sleep(sleepTime)
+	d.logger.Infow("waiting for healthcheck", "service", service.Name, "url", service.HealthcheckURL)
+	err := d.waitHealthy(ctx, service)
+	if err != nil {
+		return err
+	}
 	if service.HasSystemdService() {
 		err := runCommand(ctx, service, false, "systemctl", "is-active", "--quiet", service.Name)
 		if err != nil {
@@ -20,7 +21,8 @@ func (d *Deployer) post(ctx context.Context, service *model.Service) error {
 		}
 	}
 	if service.ComposeService {
-		err := runCommand(ctx, service, true, "sh", "-c", "docker compose ps | grep -q \"Up\" || exit 1")
+		ps := strings.Join(composeCommand(service, "ps"), " ")
+		err := runCommand(ctx, service, true, "sh", "-c", ps+" | grep -q \"Up\" || exit 1")
 		if err != nil {
 			return fmt.Errorf("could not get healthy status of docker-compose service: %w", err)
 		}
@@ -4,15 +4,23 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 
 	"github.com/btschwartz12/autodeploy/model"
 )
 
+// maxSkippedCommits caps how many commits a sync logs as skipped over.
+const maxSkippedCommits = 100
+
 func (d *Deployer) pre(ctx context.Context, service *model.Service, event *model.PushEvent) error {
+	if service.Releases != nil {
+		return d.preRelease(ctx, service, event)
+	}
 	err := d.pull(ctx, service, event)
 	if err != nil {
 		return fmt.Errorf("failed to pull: %w", err)
@@ -36,26 +44,39 @@ func (d *Deployer) pull(ctx context.Context, service *model.Service, event *mode
 	if err != nil {
 		return fmt.Errorf("failed to get HEAD: %w", err)
 	}
-	if head.Hash().String() != event.BeforeSha {
+	if event.BeforeSha == "" {
+		return d.checkout(ctx, service, repo, head, event)
+	}
+	if head.Hash().String() == event.AfterSha {
+		d.logger.Infow("already at after_sha, nothing to pull", "service", service.Name, "sha", event.AfterSha)
+		return nil
+	}
+	if service.SyncPolicy == model.SyncFastForward || service.SyncPolicy == model.SyncForce {
+		return d.sync(ctx, service, repo, head, event)
+	}
+	// another service sharing this worktree may already have pulled some
+	// of the pushed commits
+	if head.Hash().String() != event.BeforeSha && !event.HasCommit(head.Hash().String()) {
 		return fmt.Errorf("Latest local commit (%s) does not match before_sha (%s)", head.Hash().String(), event.BeforeSha)
 	}
 	worktree, err := repo.Worktree()
 	if err != nil {
 		return fmt.Errorf("failed to get worktree: %w", err)
 	}
-	status, err := worktree.Status()
-	if err != nil {
-		return fmt.Errorf("failed to get worktree status: %w", err)
+	if err := d.cleanWorktree(ctx, service, repo, worktree); err != nil {
+		return err
 	}
-	if !status.IsClean() {
-		return fmt.Errorf("worktree is not clean")
+	// pulling resets the whole worktree, which deletes untracked files that
+	// must be kept, so fetch and reset to the pushed commit without them
+	if keepsUntracked(service) {
+		if err := d.fetch(ctx, repo); err != nil {
+			return err
+		}
+		return resetWorktree(service, repo, worktree, plumbing.NewHash(event.AfterSha))
 	}
 	err = worktree.PullContext(ctx, &git.PullOptions{
-		Force: true,
-		Auth: &http.BasicAuth{
-			Username: "can-be-anything",
-			Password: d.ghToken,
-		},
+		Force:      true,
+		Auth:       d.auth(),
 		RemoteName: "autodeploy",
 	})
 	if errors.Is(err, git.NoErrAlreadyUpToDate) {
@@ -72,11 +93,8 @@ func (d *Deployer) pull(ctx context.Context, service *model.Service, event *mode
 			return fmt.Errorf("failed to reset worktree: %w", err)
 		}
 		err = worktree.PullContext(ctx, &git.PullOptions{
-			Force: true,
-			Auth: &http.BasicAuth{
-				Username: "can-be-anything",
-				Password: d.ghToken,
-			},
+			Force:      true,
+			Auth:       d.auth(),
 			RemoteName: "autodeploy",
 		})
 		if !errors.Is(err, git.NoErrAlreadyUpToDate) {
@@ -90,6 +108,234 @@ func (d *Deployer) pull(ctx context.Context, service *model.Service, event *mode
 	return nil
 }
 
+// checkout fetches from the remote and hard-resets the worktree to the
+// commit the event asks for, no matter what is checked out. It fills in
+// event.BeforeSha and event.AfterSha.
+func (d *Deployer) checkout(
+	ctx context.Context,
+	service *model.Service,
+	repo *git.Repository,
+	head *plumbing.Reference,
+	event *model.PushEvent,
+) error {
+	event.BeforeSha = head.Hash().String()
+	if event.AfterSha == event.BeforeSha {
+		d.logger.Infow("already at requested commit, nothing to check out", "service", service.Name, "sha", event.AfterSha)
+		return nil
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("failed to get worktree: %w", err)
+	}
+	if err := d.cleanWorktree(ctx, service, repo, worktree); err != nil {
+		return err
+	}
+	if err := d.fetch(ctx, repo); err != nil {
+		return err
+	}
+	target := event.AfterSha
+	if target == "" {
+		hash, err := resolveRef(repo, event.Ref)
+		if err != nil {
+			return err
+		}
+		target = hash.String()
+	}
+	if err := resetWorktree(service, repo, worktree, plumbing.NewHash(target)); err != nil {
+		return err
+	}
+	event.AfterSha = target
+	d.logger.Infow("checked out", "service", service.Name, "ref", event.Ref, "sha", target, "previous", event.BeforeSha)
+	return nil
+}
+
+// sync fetches from the remote and hard-resets the worktree to
+// event.AfterSha, for the fast-forward and force sync policies. Commits that
+// are deployed without having been part of the push, because a webhook was
+// missed, and local commits that are thrown away are logged. event.BeforeSha
+// is set to the commit the worktree was at, since that is what a rollback
+// goes back to.
+func (d *Deployer) sync(
+	ctx context.Context,
+	service *model.Service,
+	repo *git.Repository,
+	head *plumbing.Reference,
+	event *model.PushEvent,
+) error {
+	out := outputFromContext(ctx)
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("failed to get worktree: %w", err)
+	}
+	if err := d.cleanWorktree(ctx, service, repo, worktree); err != nil {
+		return err
+	}
+	if err := d.fetch(ctx, repo); err != nil {
+		return err
+	}
+	current, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return fmt.Errorf("failed to get HEAD commit: %w", err)
+	}
+	after, err := repo.CommitObject(plumbing.NewHash(event.AfterSha))
+	if err != nil {
+		return fmt.Errorf("failed to get after_sha commit: %w", err)
+	}
+	bases, err := current.MergeBase(after)
+	if err != nil {
+		return fmt.Errorf("failed to find merge base: %w", err)
+	}
+	fastForward := len(bases) == 1 && bases[0].Hash == current.Hash
+	if !fastForward && service.SyncPolicy == model.SyncFastForward {
+		return fmt.Errorf("Latest local commit (%s) is not an ancestor of after_sha (%s)", head.Hash().String(), event.AfterSha)
+	}
+	for _, c := range commitsSince(current, bases) {
+		out.Printf("%s: discarding local commit %s %s", service.SyncPolicy, shortSha(c.Hash.String()), firstLine(c.Message))
+		d.logger.Infow("discarding local commit", "service", service.Name, "sha", c.Hash.String())
+	}
+	for _, c := range commitsSince(after, bases) {
+		if event.HasCommit(c.Hash.String()) {
+			continue
+		}
+		out.Printf("%s: also deploying %s %s, which was not part of the push", service.SyncPolicy, shortSha(c.Hash.String()), firstLine(c.Message))
+		d.logger.Infow("deploying commit that was not part of the push", "service", service.Name, "sha", c.Hash.String())
+	}
+	event.BeforeSha = head.Hash().String()
+	if err := resetWorktree(service, repo, worktree, after.Hash); err != nil {
+		return err
+	}
+	d.logger.Infow("synced", "service", service.Name, "policy", service.SyncPolicy, "sha", event.AfterSha, "previous", event.BeforeSha)
+	return nil
+}
+
+// commitsSince returns the commits reachable from tip that are not reachable
+// from any of bases, newest first. Only the first maxSkippedCommits are
+// returned.
+func commitsSince(tip *object.Commit, bases []*object.Commit) []*object.Commit {
+	ignore := make([]plumbing.Hash, len(bases))
+	for i, base := range bases {
+		ignore[i] = base.Hash
+	}
+	commits := make([]*object.Commit, 0)
+	iter := object.NewCommitPreorderIter(tip, nil, ignore)
+	defer iter.Close()
+	for len(commits) < maxSkippedCommits {
+		c, err := iter.Next()
+		if err != nil {
+			break
+		}
+		commits = append(commits, c)
+	}
+	return commits
+}
+
+func firstLine(message string) string {
+	line, _, _ := strings.Cut(message, "\n")
+	return line
+}
+
+// keepsUntracked reports whether resets of the service's worktree have to
+// leave untracked files alone, because they may be shared paths or the
+// dirty_worktree policy ignores them.
+func keepsUntracked(service *model.Service) bool {
+	return len(service.SharedPaths) > 0 || service.DirtyWorktree == model.DirtyIgnoreUntracked
+}
+
+// resetWorktree hard-resets the worktree to target. If the service keeps
+// untracked files, the reset leaves out its shared paths and any untracked
+// files, so that it neither overwrites nor deletes them.
+func resetWorktree(service *model.Service, repo *git.Repository, worktree *git.Worktree, target plumbing.Hash) error {
+	opts := &git.ResetOptions{
+		Mode:   git.HardReset,
+		Commit: target,
+	}
+	if keepsUntracked(service) {
+		files, err := resetFiles(service, repo, target)
+		if err != nil {
+			return err
+		}
+		opts.Files = files
+		// no files would mean all of them, so only move HEAD
+		if len(files) == 0 {
+			opts.Mode = git.SoftReset
+		}
+	}
+	if err := worktree.Reset(opts); err != nil {
+		return fmt.Errorf("failed to reset worktree: %w", err)
+	}
+	return nil
+}
+
+// resetFiles lists the files tracked at HEAD or at target, outside the
+// service's shared paths. A reset restricted to them leaves everything else
+// in the worktree alone, while an unrestricted one deletes untracked files.
+func resetFiles(service *model.Service, repo *git.Repository, target plumbing.Hash) ([]string, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get HEAD: %w", err)
+	}
+	seen := make(map[string]bool)
+	files := make([]string, 0)
+	for _, hash := range []plumbing.Hash{head.Hash(), target} {
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get commit %s: %w", hash, err)
+		}
+		tree, err := commit.Tree()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get tree of %s: %w", hash, err)
+		}
+		err = tree.Files().ForEach(func(f *object.File) error {
+			if !seen[f.Name] && !service.IsShared(f.Name) {
+				seen[f.Name] = true
+				files = append(files, f.Name)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list files of %s: %w", hash, err)
+		}
+	}
+	return files, nil
+}
+
+func (d *Deployer) fetch(ctx context.Context, repo *git.Repository) error {
+	err := repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: "autodeploy",
+		Auth:       d.auth(),
+		Tags:       git.AllTags,
+		Force:      true,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return fmt.Errorf("failed to fetch: %w", err)
+	}
+	return nil
+}
+
+// resolveRef finds the commit for a tag, a branch on the autodeploy remote,
+// or anything else git can resolve, like a sha.
+func resolveRef(repo *git.Repository, ref string) (*plumbing.Hash, error) {
+	candidates := []string{
+		"refs/tags/" + ref,
+		"refs/remotes/autodeploy/" + strings.TrimPrefix(ref, "refs/heads/"),
+		ref,
+	}
+	for _, c := range candidates {
+		hash, err := repo.ResolveRevision(plumbing.Revision(c))
+		if err == nil {
+			return hash, nil
+		}
+	}
+	return nil, fmt.Errorf("could not resolve ref: %s", ref)
+}
+
+func (d *Deployer) auth() *http.BasicAuth {
+	return &http.BasicAuth{
+		Username: "can-be-anything",
+		Password: d.ghToken,
+	}
+}
+
 func (d *Deployer) build(ctx context.Context, service *model.Service) error {
 	if service.HasBuildCommand() {
 		d.logger.Infow("running build command", "service", service.Name, "command", service.BuildCommand)
@@ -102,10 +348,42 @@ func (d *Deployer) build(ctx context.Context, service *model.Service) error {
 	}
 	if service.ComposeService {
 		d.logger.Infow("building docker compose service", "service", service.Name)
-		err := runCommand(ctx, service, true, "docker", "compose", "build")
+		err := runCommand(ctx, service, true, composeCommand(service, "build")...)
 		if err != nil {
 			return fmt.Errorf("failed to run docker compose build: %w", err)
 		}
 	}
 	return nil
 }
+
+// CurrentSha returns the commit that is currently checked out for service.
+func (d *Deployer) CurrentSha(service *model.Service) (string, error) {
+	_, sha, err := d.CurrentRef(service)
+	return sha, err
+}
+
+// CurrentRef returns the ref (usually a branch) and commit that are currently
+// checked out for service. If HEAD is detached, the ref is the commit. In
+// release mode, both are the commit of the current release.
+func (d *Deployer) CurrentRef(service *model.Service) (string, string, error) {
+	if service.Releases != nil {
+		_, sha, err := liveRelease(service)
+		if err == nil && sha == "" {
+			err = fmt.Errorf("no release deployed yet")
+		}
+		return sha, sha, err
+	}
+	repo, err := git.PlainOpen(service.Path)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to open git repo: %w", err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get HEAD: %w", err)
+	}
+	sha := head.Hash().String()
+	if head.Name() == plumbing.HEAD {
+		return sha, sha, nil
+	}
+	return head.Name().String(), sha, nil
+}
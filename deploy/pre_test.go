@@ -97,7 +97,7 @@ func TestPull(t *testing.T) {
 	})
 	assert.NoError(t, err)
 	// now we can do the thing
-	deployer := New(zap.NewNop().Sugar(), string(token))
+	deployer := New(zap.NewNop().Sugar(), string(token), nil)
 	err = deployer.pull(
 		context.Background(),
 		&model.Service{
@@ -127,7 +127,7 @@ func TestBuild(t *testing.T) {
 		Path:         tmpDir,
 		BuildCommand: "echo 'hello, world!'",
 	}
-	deployer := New(zap.NewNop().Sugar(), "")
+	deployer := New(zap.NewNop().Sugar(), "", nil)
 	err := deployer.build(context.Background(), service)
 	assert.NoError(t, err)
 
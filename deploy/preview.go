@@ -0,0 +1,190 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/google/go-github/v68/github"
+
+	"github.com/btschwartz12/autodeploy/model"
+)
+
+// DeployPreview brings up the preview environment of pr for service. The
+// head of the pull request is checked out into its own directory, then built
+// and started as its own compose project. The preview URL is posted to the
+// pull request and to a transient GitHub environment. It returns the URL.
+func (d *Deployer) DeployPreview(ctx context.Context, service *model.Service, pr *model.PullRequest) (string, error) {
+	preview := service.PreviewService(pr.Number)
+	event := pr.PushEvent()
+	d.logger.Infow("deploying preview", "service", service.Name, "pr", pr.Number, "sha", pr.HeadSha)
+	deploymentID, err := d.notifyBegin(ctx, preview, event)
+	if err != nil {
+		return "", fmt.Errorf("failed to notify: %w", err)
+	}
+	err = d.deployPreview(ctx, service, preview, event)
+	if err != nil {
+		notifyErr := d.notifyFinish(ctx, deploymentID, preview, event, StateFailure, "")
+		if notifyErr != nil {
+			d.logger.Errorw("failed to notify failure", "error", notifyErr)
+		}
+		return "", err
+	}
+	notifyErr := d.notifyFinish(ctx, deploymentID, preview, event, StateSuccess, "")
+	if notifyErr != nil {
+		d.logger.Errorw("failed to notify success", "error", notifyErr)
+	}
+	body := fmt.Sprintf("🔎 Preview of `%s` at %s is up at %s", service.Name, shortSha(pr.HeadSha), preview.HealthcheckURL)
+	if err := d.upsertPreviewComment(ctx, service, pr, body); err != nil {
+		d.logger.Errorw("failed to comment on pull request", "service", service.Name, "pr", pr.Number, "error", err)
+	}
+	return preview.HealthcheckURL, nil
+}
+
+func (d *Deployer) deployPreview(
+	ctx context.Context,
+	service *model.Service,
+	preview *model.Service,
+	event *model.PushEvent,
+) error {
+	if err := d.cloneRepo(ctx, preview, preview.Path); err != nil {
+		return fmt.Errorf("failed to clone: %w", err)
+	}
+	if err := copyShared(service, preview); err != nil {
+		return fmt.Errorf("failed to copy shared paths: %w", err)
+	}
+	if err := d.pre(ctx, preview, event); err != nil {
+		return fmt.Errorf("pre-activation failed: %w", err)
+	}
+	if err := d.activate(ctx, preview); err != nil {
+		return fmt.Errorf("activation failed: %w", err)
+	}
+	return nil
+}
+
+// cloneRepo clones the service's repository into dir, unless that was done
+// for an earlier deployment.
+func (d *Deployer) cloneRepo(ctx context.Context, service *model.Service, dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return nil
+	}
+	_, err := git.PlainCloneContext(ctx, dir, false, &git.CloneOptions{
+		URL:        fmt.Sprintf("https://github.com/%s/%s.git", service.Owner(), service.RepoName()),
+		RemoteName: "autodeploy",
+		Auth:       d.auth(),
+	})
+	if err != nil {
+		// don't leave a half cloned repository behind
+		os.RemoveAll(dir)
+		return err
+	}
+	return nil
+}
+
+// copyShared copies the shared files of service into the preview, unless the
+// preview already has them. Shared directories are created empty, so previews
+// don't start out with, or write to, the service's data.
+func copyShared(service *model.Service, preview *model.Service) error {
+	for _, p := range service.SharedPaths {
+		name := filepath.FromSlash(strings.TrimSuffix(p, "/"))
+		dst := filepath.Join(preview.WorkDir(), name)
+		if strings.HasSuffix(p, "/") {
+			if err := os.MkdirAll(dst, 0o755); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := os.Lstat(dst); err == nil {
+			continue
+		}
+		contents, err := os.ReadFile(filepath.Join(service.WorkDir(), name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(dst, contents, 0o600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemovePreview stops the preview environment of pr for service, deletes its
+// directory and marks its GitHub deployments inactive.
+func (d *Deployer) RemovePreview(ctx context.Context, service *model.Service, pr *model.PullRequest) error {
+	preview := service.PreviewService(pr.Number)
+	d.logger.Infow("removing preview", "service", service.Name, "pr", pr.Number)
+	if _, err := os.Stat(preview.Path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	err := runCommand(ctx, preview, true, composeCommand(preview, "down", "--volumes", "--remove-orphans")...)
+	if err != nil {
+		return fmt.Errorf("failed to stop preview: %w", err)
+	}
+	if err := os.RemoveAll(preview.Path); err != nil {
+		return fmt.Errorf("failed to remove preview directory: %w", err)
+	}
+	if err := d.deactivateEnvironment(ctx, preview, pr.PushEvent()); err != nil {
+		d.logger.Errorw("failed to deactivate preview environment", "service", service.Name, "pr", pr.Number, "error", err)
+	}
+	body := fmt.Sprintf("🔎 Preview of `%s` was removed", service.Name)
+	if err := d.upsertPreviewComment(ctx, service, pr, body); err != nil {
+		d.logger.Errorw("failed to comment on pull request", "service", service.Name, "pr", pr.Number, "error", err)
+	}
+	return nil
+}
+
+// deactivateEnvironment marks the deployments in the service's environment
+// inactive.
+func (d *Deployer) deactivateEnvironment(ctx context.Context, service *model.Service, event *model.PushEvent) error {
+	deployments, _, err := d.client.ListDeployments(ctx, event.Owner, event.Repo, &github.DeploymentsListOptions{
+		Environment: service.Environment,
+		ListOptions: github.ListOptions{PerPage: 100},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list deployments: %w", err)
+	}
+	for _, deployment := range deployments {
+		err := d.createDeploymentStatus(ctx, deployment.GetID(), service, event, StateInactive, "pull request closed")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upsertPreviewComment posts body on the pull request, editing the comment
+// from an earlier push instead if there is one.
+func (d *Deployer) upsertPreviewComment(ctx context.Context, service *model.Service, pr *model.PullRequest, body string) error {
+	marker := fmt.Sprintf("<!-- autodeploy preview %s -->", service.Name)
+	body = marker + "\n" + body
+	comments, _, err := d.issues.ListComments(ctx, pr.Owner, pr.Repo, pr.Number, &github.IssueListCommentsOptions{
+		ListOptions: github.ListOptions{PerPage: 100},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list comments: %w", err)
+	}
+	for _, comment := range comments {
+		if strings.HasPrefix(comment.GetBody(), marker) {
+			_, _, err := d.issues.EditComment(ctx, pr.Owner, pr.Repo, comment.GetID(), &github.IssueComment{Body: &body})
+			if err != nil {
+				return fmt.Errorf("failed to edit comment: %w", err)
+			}
+			return nil
+		}
+	}
+	_, _, err = d.issues.CreateComment(ctx, pr.Owner, pr.Repo, pr.Number, &github.IssueComment{Body: &body})
+	if err != nil {
+		return fmt.Errorf("failed to create comment: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,316 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/btschwartz12/autodeploy/model"
+)
+
+// The layout of a service's path in release mode.
+const (
+	releaseRepoDir    = "repo"
+	releasesDir       = "releases"
+	currentRelease    = "current"
+	sharedDir         = "shared"
+	releaseTimeFormat = "20060102150405.000000"
+)
+
+// preRelease is pre for services in release mode. The commit is exported
+// from a clone of the repository into a new release directory and built
+// there, then the current symlink is switched to it. The previous release is
+// left untouched, so event.BeforeSha is set to it for rollbacks. Manual
+// rollbacks to a release that was not pruned yet only switch the symlink.
+func (d *Deployer) preRelease(ctx context.Context, service *model.Service, event *model.PushEvent) error {
+	out := outputFromContext(ctx)
+	previous, live, err := liveRelease(service)
+	if err != nil {
+		return err
+	}
+	// a release that is still around is already built
+	if event.Trigger == model.TriggerRollback && event.AfterSha != "" {
+		if dir, err := findRelease(service, event.AfterSha); err == nil {
+			event.BeforeSha = live
+			if err := switchRelease(service, dir); err != nil {
+				return err
+			}
+			out.Printf("switched to release %s", filepath.Base(dir))
+			return nil
+		}
+	}
+	repoDir := filepath.Join(service.Path, releaseRepoDir)
+	if err := d.cloneRepo(ctx, service, repoDir); err != nil {
+		return fmt.Errorf("failed to clone: %w", err)
+	}
+	repo, err := git.PlainOpen(repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to open git repo: %w", err)
+	}
+	if err := d.fetch(ctx, repo); err != nil {
+		return err
+	}
+	sha := event.AfterSha
+	if sha == "" {
+		hash, err := resolveRef(repo, event.Ref)
+		if err != nil {
+			return err
+		}
+		sha = hash.String()
+	}
+	commit, err := repo.CommitObject(plumbing.NewHash(sha))
+	if err != nil {
+		return fmt.Errorf("failed to get commit %s: %w", sha, err)
+	}
+	event.BeforeSha = live
+	event.AfterSha = sha
+
+	dir, err := exportRelease(service, commit)
+	if err != nil {
+		return fmt.Errorf("failed to export release: %w", err)
+	}
+	out.Printf("exported %s to %s", shortSha(sha), filepath.Base(dir))
+	if err := d.buildRelease(ctx, service, dir); err != nil {
+		d.removeRelease(service, dir)
+		return err
+	}
+	out.Printf("switched to release %s", filepath.Base(dir))
+	if err := pruneReleases(service, previous); err != nil {
+		d.logger.Errorw("failed to prune releases", "service", service.Name, "error", err)
+	}
+	return nil
+}
+
+// buildRelease builds the release at dir and switches to it.
+func (d *Deployer) buildRelease(ctx context.Context, service *model.Service, dir string) error {
+	if err := linkShared(service, dir); err != nil {
+		return fmt.Errorf("failed to link shared paths: %w", err)
+	}
+	release := *service
+	release.Path = dir
+	release.Releases = nil
+	if err := d.build(ctx, &release); err != nil {
+		return fmt.Errorf("failed to build: %w", err)
+	}
+	d.logger.Infow("built", "service", service.Name, "release", filepath.Base(dir))
+	return switchRelease(service, dir)
+}
+
+// removeRelease removes a release that failed. Kept around, it would count
+// towards releases.keep and push out the releases that can be rolled back to.
+func (d *Deployer) removeRelease(service *model.Service, dir string) {
+	if err := os.RemoveAll(dir); err != nil {
+		d.logger.Errorw("failed to remove failed release", "service", service.Name, "release", filepath.Base(dir), "error", err)
+		return
+	}
+	d.logger.Infow("removed failed release", "service", service.Name, "release", filepath.Base(dir))
+}
+
+// exportRelease writes the files of commit into a new release directory and
+// returns its path. The directory only shows up once it is complete.
+func exportRelease(service *model.Service, commit *object.Commit) (string, error) {
+	name := fmt.Sprintf("%s-%s", time.Now().UTC().Format(releaseTimeFormat), commit.Hash)
+	dir := filepath.Join(service.Path, releasesDir, name)
+	tmp := dir + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(tmp, 0o755); err != nil {
+		return "", err
+	}
+	files, err := commit.Files()
+	if err != nil {
+		return "", fmt.Errorf("failed to list files: %w", err)
+	}
+	err = files.ForEach(func(f *object.File) error {
+		return exportFile(f, filepath.Join(tmp, filepath.FromSlash(f.Name)))
+	})
+	if err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	return dir, nil
+}
+
+func exportFile(f *object.File, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if f.Mode == filemode.Symlink {
+		target, err := f.Contents()
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, path)
+	}
+	perm := os.FileMode(0o644)
+	if f.Mode == filemode.Executable {
+		perm = 0o755
+	}
+	r, err := f.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// linkShared replaces the service's shared paths in the release at dir with
+// links into path/shared, so they carry over from release to release. A
+// shared path that doesn't exist yet is seeded from the release, if it has it.
+func linkShared(service *model.Service, dir string) error {
+	for _, p := range service.SharedPaths {
+		name := filepath.FromSlash(strings.TrimSuffix(p, "/"))
+		shared := filepath.Join(service.Path, sharedDir, name)
+		link := filepath.Join(dir, service.Subdir, name)
+		if err := os.MkdirAll(filepath.Dir(shared), 0o755); err != nil {
+			return err
+		}
+		if _, err := os.Lstat(shared); errors.Is(err, os.ErrNotExist) {
+			if err := os.Rename(link, shared); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		if strings.HasSuffix(p, "/") {
+			if err := os.MkdirAll(shared, 0o755); err != nil {
+				return err
+			}
+		}
+		if err := os.RemoveAll(link); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(link), 0o755); err != nil {
+			return err
+		}
+		target, err := filepath.Rel(filepath.Dir(link), shared)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// switchRelease atomically points the current symlink at dir.
+func switchRelease(service *model.Service, dir string) error {
+	link := filepath.Join(service.Path, currentRelease)
+	tmp := link + ".tmp"
+	target, err := filepath.Rel(service.Path, dir)
+	if err != nil {
+		return err
+	}
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return fmt.Errorf("failed to link release: %w", err)
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to switch release: %w", err)
+	}
+	return nil
+}
+
+// liveRelease returns the directory name and commit of the current release.
+// Both are empty if nothing was deployed yet.
+func liveRelease(service *model.Service) (string, string, error) {
+	target, err := os.Readlink(filepath.Join(service.Path, currentRelease))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read current release: %w", err)
+	}
+	name := filepath.Base(target)
+	return name, releaseSha(name), nil
+}
+
+func releaseSha(name string) string {
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return ""
+	}
+	return name[i+1:]
+}
+
+// listReleases returns the names of the complete releases, oldest first.
+func listReleases(service *model.Service) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(service.Path, releasesDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasSuffix(entry.Name(), ".tmp") {
+			names = append(names, entry.Name())
+		}
+	}
+	// names start with the time they were made
+	slices.Sort(names)
+	return names, nil
+}
+
+// findRelease returns the directory of the newest release of sha.
+func findRelease(service *model.Service, sha string) (string, error) {
+	names, err := listReleases(service)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range slices.Backward(names) {
+		if releaseSha(name) == sha {
+			return filepath.Join(service.Path, releasesDir, name), nil
+		}
+	}
+	return "", fmt.Errorf("no release of %s", shortSha(sha))
+}
+
+// pruneReleases removes all but the newest releases.Keep releases. The
+// current release is always kept, and so is previous, the release that was
+// live before it, so that a failed deployment can still be rolled back.
+func pruneReleases(service *model.Service, previous string) error {
+	names, err := listReleases(service)
+	if err != nil {
+		return err
+	}
+	live, _, err := liveRelease(service)
+	if err != nil {
+		return err
+	}
+	errs := make([]error, 0)
+	for i, name := range names {
+		if i >= len(names)-service.Releases.Keep || name == live || name == previous {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(service.Path, releasesDir, name)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
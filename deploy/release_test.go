@@ -0,0 +1,158 @@
+package deploy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btschwartz12/autodeploy/model"
+	"github.com/go-git/go-git/v5"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestReleases(t *testing.T) {
+	upstream, upstreamDir, _, shas := getTestRemote(t)
+	shas = append(shas, commitFile(t, upstream, upstreamDir, "version", "3"))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	root := t.TempDir()
+	_, err := git.PlainClone(filepath.Join(root, releaseRepoDir), false, &git.CloneOptions{
+		URL:        upstreamDir,
+		RemoteName: "autodeploy",
+	})
+	assert.NoError(t, err)
+	service := getHealthcheckService(server.URL)
+	service.Path = root
+	service.Releases = &model.Releases{Keep: 2}
+	service.BuildCommand = "touch built"
+	service.FlowTimeout = model.Duration(10 * time.Second)
+	deployer := New(zap.NewNop().Sugar(), "", nil)
+	ctx := context.Background()
+
+	_, err = deployer.CurrentSha(service)
+	assert.ErrorContains(t, err, "no release deployed yet")
+
+	event := &model.PushEvent{Ref: "v1", Trigger: model.TriggerManual}
+	assert.NoError(t, deployer.pre(ctx, service, event))
+	assert.Equal(t, "", event.BeforeSha)
+	assert.Equal(t, shas[0], event.AfterSha)
+	assert.Equal(t, "1", readVersion(t, service.WorkDir()))
+	assert.FileExists(t, filepath.Join(service.WorkDir(), "built"))
+	assert.NoDirExists(t, filepath.Join(service.WorkDir(), ".git"))
+
+	for i, sha := range shas[1:] {
+		event = &model.PushEvent{Ref: "refs/heads/master", BeforeSha: shas[i], AfterSha: sha, Trigger: model.TriggerPush}
+		assert.NoError(t, deployer.pre(ctx, service, event))
+		assert.Equal(t, shas[i], event.BeforeSha)
+	}
+	assert.Equal(t, "3", readVersion(t, service.WorkDir()))
+	sha, err := deployer.CurrentSha(service)
+	assert.NoError(t, err)
+	assert.Equal(t, shas[2], sha)
+
+	// only the newest two releases are kept
+	names, err := listReleases(service)
+	assert.NoError(t, err)
+	assert.Len(t, names, 2)
+	assert.Equal(t, shas[1], releaseSha(names[0]))
+
+	// a manual rollback to a kept release only switches the symlink
+	assert.NoError(t, os.Remove(filepath.Join(root, releasesDir, names[0], "built")))
+	event = &model.PushEvent{Ref: "refs/heads/master", AfterSha: shas[1], Trigger: model.TriggerRollback}
+	assert.NoError(t, deployer.pre(ctx, service, event))
+	assert.Equal(t, shas[2], event.BeforeSha)
+	assert.Equal(t, "2", readVersion(t, service.WorkDir()))
+	assert.NoFileExists(t, filepath.Join(service.WorkDir(), "built"))
+
+	// rolling back a failed deployment switches to the previous release
+	// without building it again, and removes the failed one
+	assert.NoError(t, os.Remove(filepath.Join(root, releasesDir, names[1], "built")))
+	assert.NoError(t, deployer.rollback(ctx, service, event))
+	assert.Equal(t, "3", readVersion(t, service.WorkDir()))
+	assert.NoFileExists(t, filepath.Join(service.WorkDir(), "built"))
+	kept, err := listReleases(service)
+	assert.NoError(t, err)
+	assert.Equal(t, names[1:], kept)
+
+	event = &model.PushEvent{BeforeSha: shas[0], AfterSha: shas[2]}
+	assert.ErrorContains(t, deployer.rollback(ctx, service, event), "no release of")
+
+	// so is a release that fails to build
+	service.BuildCommand = "exit 1"
+	event = &model.PushEvent{Ref: "v1", Trigger: model.TriggerManual}
+	assert.ErrorContains(t, deployer.pre(ctx, service, event), "failed to build")
+	kept, err = listReleases(service)
+	assert.NoError(t, err)
+	assert.Equal(t, names[1:], kept)
+	assert.Equal(t, "3", readVersion(t, service.WorkDir()))
+}
+
+func TestReleasesKeepPrevious(t *testing.T) {
+	_, upstreamDir, _, shas := getTestRemote(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	root := t.TempDir()
+	_, err := git.PlainClone(filepath.Join(root, releaseRepoDir), false, &git.CloneOptions{
+		URL:        upstreamDir,
+		RemoteName: "autodeploy",
+	})
+	assert.NoError(t, err)
+	service := getHealthcheckService(server.URL)
+	service.Path = root
+	service.Releases = &model.Releases{Keep: 1}
+	service.FlowTimeout = model.Duration(10 * time.Second)
+	deployer := New(zap.NewNop().Sugar(), "", nil)
+	ctx := context.Background()
+
+	assert.NoError(t, deployer.pre(ctx, service, &model.PushEvent{Ref: "v1", Trigger: model.TriggerManual}))
+	event := &model.PushEvent{Ref: "refs/heads/master", BeforeSha: shas[0], AfterSha: shas[1], Trigger: model.TriggerPush}
+	assert.NoError(t, deployer.pre(ctx, service, event))
+
+	// the release from before the switch is kept for rolling back
+	names, err := listReleases(service)
+	assert.NoError(t, err)
+	assert.Len(t, names, 2)
+	assert.NoError(t, deployer.rollback(ctx, service, event))
+	assert.Equal(t, "1", readVersion(t, service.WorkDir()))
+}
+
+func TestLinkShared(t *testing.T) {
+	root := t.TempDir()
+	service := &model.Service{Path: root, Subdir: "api", SharedPaths: []string{".env", "data/", "config/app.yml"}}
+	release := func(name string) string {
+		dir := filepath.Join(root, releasesDir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, "api", "config"), 0o755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "api", "config", "app.yml"), []byte(name), 0o644))
+		assert.NoError(t, linkShared(service, dir))
+		return filepath.Join(dir, "api")
+	}
+
+	first := release("1")
+	// the tracked file seeds the shared one, the others start out missing
+	assert.Equal(t, "1", readFile(t, filepath.Join(first, "config", "app.yml")))
+	assert.DirExists(t, filepath.Join(root, sharedDir, "data"))
+	assert.NoError(t, os.WriteFile(filepath.Join(first, ".env"), []byte("A=1"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(first, "data", "db"), []byte("rows"), 0o644))
+
+	second := release("2")
+	assert.Equal(t, "1", readFile(t, filepath.Join(second, "config", "app.yml")))
+	assert.Equal(t, "A=1", readFile(t, filepath.Join(second, ".env")))
+	assert.Equal(t, "rows", readFile(t, filepath.Join(second, "data", "db")))
+
+	// removing a release leaves the shared files alone
+	assert.NoError(t, os.RemoveAll(filepath.Join(root, releasesDir, "1")))
+	assert.Equal(t, "rows", readFile(t, filepath.Join(root, sharedDir, "data", "db")))
+}
+
+func readFile(t *testing.T, path string) string {
+	contents, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	return string(contents)
+}
@@ -0,0 +1,107 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"github.com/btschwartz12/autodeploy/model"
+)
+
+// RollbackError is returned by Deploy when a failed deployment was rolled back
+// to the previous commit. Err is why the deployment failed, and RollbackErr is
+// nil if the rollback itself succeeded.
+type RollbackError struct {
+	Err         error
+	RollbackErr error
+	Sha         string
+}
+
+func (e *RollbackError) Error() string {
+	if e.RollbackErr != nil {
+		return fmt.Sprintf("%s; rollback to %s failed: %s", e.Err, e.Sha, e.RollbackErr)
+	}
+	return fmt.Sprintf("%s; rolled back to %s", e.Err, e.Sha)
+}
+
+func (e *RollbackError) Unwrap() error {
+	return e.Err
+}
+
+// rollback resets the worktree to event.BeforeSha and runs the build,
+// activation and post-activation steps again. In release mode, it switches
+// back to the release of event.BeforeSha instead, which is already built, and
+// removes the release that failed. It
+// gets a fresh flow timeout, since the failed deployment may have used up ctx,
+// but is still cut off if ctx is interrupted.
+func (d *Deployer) rollback(ctx context.Context, service *model.Service, event *model.PushEvent) error {
+	parent := ctx
+	ctx, interrupt := context.WithCancelCause(context.WithoutCancel(parent))
+	defer interrupt(nil)
+	stop := context.AfterFunc(parent, func() {
+		if interrupted(parent) {
+			interrupt(context.Cause(parent))
+		}
+	})
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(service.FlowTimeout))
+	defer cancel()
+
+	if event.BeforeSha == "" || strings.Trim(event.BeforeSha, "0") == "" {
+		return fmt.Errorf("no previous commit to roll back to")
+	}
+	if service.Releases != nil {
+		failed, _, err := liveRelease(service)
+		if err != nil {
+			return err
+		}
+		dir, err := findRelease(service, event.BeforeSha)
+		if err != nil {
+			return err
+		}
+		if err := switchRelease(service, dir); err != nil {
+			return err
+		}
+		d.logger.Infow("switched release", "service", service.Name, "release", filepath.Base(dir))
+		if failed != "" && failed != filepath.Base(dir) {
+			d.removeRelease(service, filepath.Join(service.Path, releasesDir, failed))
+		}
+	} else {
+		err := d.reset(service, event.BeforeSha)
+		if err != nil {
+			return fmt.Errorf("failed to reset: %w", err)
+		}
+		d.logger.Infow("reset worktree", "service", service.Name, "sha", event.BeforeSha)
+
+		err = d.build(ctx, service)
+		if err != nil {
+			return fmt.Errorf("failed to build: %w", err)
+		}
+	}
+	err := d.activate(ctx, service)
+	if err != nil {
+		return fmt.Errorf("activation failed: %w", err)
+	}
+	err = d.post(ctx, service)
+	if err != nil {
+		return fmt.Errorf("post-activation failed: %w", err)
+	}
+	return nil
+}
+
+func (d *Deployer) reset(service *model.Service, sha string) error {
+	repo, err := git.PlainOpen(service.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open git repo: %w", err)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("failed to get worktree: %w", err)
+	}
+	return resetWorktree(service, repo, worktree, plumbing.NewHash(sha))
+}
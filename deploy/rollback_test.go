@@ -0,0 +1,83 @@
+package deploy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btschwartz12/autodeploy/model"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// commitFile writes name with the given contents and commits it, returning the new sha.
+func commitFile(t *testing.T, repo *git.Repository, dir, name, contents string) string {
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644))
+	w, err := repo.Worktree()
+	assert.NoError(t, err)
+	_, err = w.Add(name)
+	assert.NoError(t, err)
+	hash, err := w.Commit("test commit", &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "John Doe",
+			Email: "john@doe.org",
+			When:  time.Now(),
+		},
+	})
+	assert.NoError(t, err)
+	return hash.String()
+}
+
+func TestReset(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	assert.NoError(t, err)
+	beforeSha := commitFile(t, repo, dir, "version", "1")
+	commitFile(t, repo, dir, "version", "2")
+
+	deployer := New(zap.NewNop().Sugar(), "", nil)
+	err = deployer.reset(&model.Service{Name: "test", Path: dir}, beforeSha)
+	assert.NoError(t, err)
+
+	head, err := repo.Head()
+	assert.NoError(t, err)
+	assert.Equal(t, beforeSha, head.Hash().String())
+	version, err := os.ReadFile(filepath.Join(dir, "version"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", string(version))
+}
+
+func TestRollbackError(t *testing.T) {
+	deployErr := errors.New("activation failed")
+	err := &RollbackError{Err: deployErr, Sha: "abc"}
+	assert.ErrorIs(t, err, deployErr)
+	assert.Equal(t, "activation failed; rolled back to abc", err.Error())
+
+	err.RollbackErr = errors.New("build failed")
+	assert.Equal(t, "activation failed; rollback to abc failed: build failed", err.Error())
+}
+
+func TestResetKeepsSharedPaths(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	assert.NoError(t, err)
+	commitFile(t, repo, dir, ".env", "A=1")
+	beforeSha := commitFile(t, repo, dir, "version", "1")
+	commitFile(t, repo, dir, "version", "2")
+	commitFile(t, repo, dir, ".env", "A=2")
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, ".env"), []byte("A=local"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "app.db"), nil, 0o644))
+
+	deployer := New(zap.NewNop().Sugar(), "", nil)
+	service := &model.Service{Name: "test", Path: dir, SharedPaths: []string{".env", "app.db"}}
+	assert.NoError(t, deployer.reset(service, beforeSha))
+	assert.Equal(t, "1", readVersion(t, dir))
+	env, err := os.ReadFile(filepath.Join(dir, ".env"))
+	assert.NoError(t, err)
+	assert.Equal(t, "A=local", string(env))
+	assert.FileExists(t, filepath.Join(dir, "app.db"))
+}
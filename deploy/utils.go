@@ -4,25 +4,75 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"maps"
+	"os"
 	"os/exec"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/btschwartz12/autodeploy/model"
 )
 
+// commandWaitDelay is how long a cancelled command may keep its output open
+// before it is abandoned.
+const commandWaitDelay = 5 * time.Second
+
 func runCommand(ctx context.Context, service *model.Service, forceNoSudo bool, command ...string) error {
-	var stdout, stderr bytes.Buffer
+	var stderr bytes.Buffer
 	var cmd *exec.Cmd
 	if service.NeedsSudo && !forceNoSudo {
 		cmd = exec.CommandContext(ctx, "sudo", command...)
 	} else {
 		cmd = exec.CommandContext(ctx, command[0], command[1:]...)
 	}
-	cmd.Dir = service.Path
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	cmd.Dir = service.WorkDir()
+	// kill the whole process group when ctx is done, so commands started by a
+	// shell don't outlive it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = commandWaitDelay
+	if len(service.Env) > 0 {
+		cmd.Env = os.Environ()
+		for _, k := range slices.Sorted(maps.Keys(service.Env)) {
+			cmd.Env = append(cmd.Env, k+"="+service.Env[k])
+		}
+	}
+
+	// stdout and stderr are combined in the deployment output
+	out := outputFromContext(ctx)
+	out.Printf("$ %s", strings.Join(cmd.Args, " "))
+	stdoutW, stderrW := out.Writer(), out.Writer()
+	defer stdoutW.Close()
+	defer stderrW.Close()
+	cmd.Stdout = stdoutW
+	cmd.Stderr = io.MultiWriter(&stderr, stderrW)
+
 	err := cmd.Run()
 	if err != nil {
+		out.Printf("command failed: %s", err)
 		return fmt.Errorf("failed to run command: %w\n%s", err, stderr.String())
 	}
 	return nil
 }
+
+// composeCommand returns the docker compose command line for args, in the
+// service's compose project if it has one.
+func composeCommand(service *model.Service, args ...string) []string {
+	command := []string{"docker", "compose"}
+	if service.ComposeProject != "" {
+		command = append(command, "--project-name", service.ComposeProject)
+	}
+	return append(command, args...)
+}
+
+func shortSha(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
@@ -0,0 +1,204 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v68/github"
+
+	"github.com/btschwartz12/autodeploy/model"
+)
+
+// workflowPollInterval is how often dispatched workflow runs are checked.
+var workflowPollInterval = 10 * time.Second
+
+// triggerWorkflows dispatches the service's workflows on the deployed ref,
+// and waits for their runs to finish if the service asks for it. The results
+// are saved in record. It returns an error if any workflow could not be
+// dispatched or did not succeed.
+func (d *Deployer) triggerWorkflows(
+	ctx context.Context,
+	service *model.Service,
+	event *model.PushEvent,
+	record *model.Deployment,
+) error {
+	out := outputFromContext(ctx)
+	inputs := map[string]interface{}{
+		"service":         service.Name,
+		"host":            service.Hostname,
+		"sha":             event.AfterSha,
+		"environment_url": service.HealthcheckURL,
+	}
+	record.Workflows = make([]model.WorkflowRun, len(service.TriggerWorkflows))
+	ref, err := workflowRef(event)
+	if err != nil {
+		out.Printf("skipping workflows: %s", err)
+		for i, workflow := range service.TriggerWorkflows {
+			record.Workflows[i] = model.WorkflowRun{Workflow: workflow, Error: err.Error()}
+		}
+		return err
+	}
+	// runs are looked up by when they were created, so that runs for the
+	// same commit from pushes or earlier deployments aren't mistaken for ours
+	dispatched := make([]time.Time, len(service.TriggerWorkflows))
+	errs := make([]error, 0)
+	for i, workflow := range service.TriggerWorkflows {
+		run := &record.Workflows[i]
+		run.Workflow = workflow
+		// GitHub only filters by the second
+		dispatched[i] = time.Now().Truncate(time.Second)
+		if err := d.dispatchWorkflow(ctx, event, workflow, ref, inputs); err != nil {
+			run.Error = err.Error()
+			errs = append(errs, fmt.Errorf("%s: %w", workflow, err))
+			continue
+		}
+		out.Printf("dispatched workflow %s on %s", workflow, ref)
+	}
+	if !service.WaitForWorkflows {
+		return errors.Join(errs...)
+	}
+	for i := range record.Workflows {
+		run := &record.Workflows[i]
+		if run.Error != "" {
+			continue
+		}
+		if err := d.waitWorkflow(ctx, event, run, dispatched[i]); err != nil {
+			run.Error = err.Error()
+			errs = append(errs, fmt.Errorf("%s: %w", run.Workflow, err))
+			continue
+		}
+		out.Printf("workflow %s finished: %s %s", run.Workflow, run.Conclusion, run.URL)
+		if run.Conclusion != "success" {
+			errs = append(errs, fmt.Errorf("%s: %s", run.Workflow, run.Conclusion))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (d *Deployer) dispatchWorkflow(
+	ctx context.Context,
+	event *model.PushEvent,
+	workflow string,
+	ref string,
+	inputs map[string]interface{},
+) error {
+	request := github.CreateWorkflowDispatchEventRequest{
+		Ref:    ref,
+		Inputs: inputs,
+	}
+	var resp *github.Response
+	var err error
+	if id, ok := workflowID(workflow); ok {
+		resp, err = d.actions.CreateWorkflowDispatchEventByID(ctx, event.Owner, event.Repo, id, request)
+	} else {
+		resp, err = d.actions.CreateWorkflowDispatchEventByFileName(ctx, event.Owner, event.Repo, workflow, request)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to dispatch workflow: %w", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected return code when dispatching workflow: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// waitWorkflow finds the run that was dispatched for run.Workflow at since
+// and waits for it to complete.
+func (d *Deployer) waitWorkflow(
+	ctx context.Context,
+	event *model.PushEvent,
+	run *model.WorkflowRun,
+	since time.Time,
+) error {
+	ticker := time.NewTicker(workflowPollInterval)
+	defer ticker.Stop()
+	for {
+		var err error
+		if run.RunID == 0 {
+			err = d.findWorkflowRun(ctx, event, run, since)
+		} else {
+			err = d.updateWorkflowRun(ctx, event, run)
+		}
+		if err != nil {
+			return err
+		}
+		if run.Conclusion != "" {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("workflow did not finish: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Deployer) findWorkflowRun(
+	ctx context.Context,
+	event *model.PushEvent,
+	run *model.WorkflowRun,
+	since time.Time,
+) error {
+	opts := &github.ListWorkflowRunsOptions{
+		Event:   "workflow_dispatch",
+		HeadSHA: event.AfterSha,
+		Created: ">=" + since.UTC().Format(time.RFC3339),
+	}
+	var runs *github.WorkflowRuns
+	var err error
+	if id, ok := workflowID(run.Workflow); ok {
+		runs, _, err = d.actions.ListWorkflowRunsByID(ctx, event.Owner, event.Repo, id, opts)
+	} else {
+		runs, _, err = d.actions.ListWorkflowRunsByFileName(ctx, event.Owner, event.Repo, run.Workflow, opts)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list workflow runs: %w", err)
+	}
+	// the run may not have been created yet
+	if len(runs.WorkflowRuns) == 0 {
+		return nil
+	}
+	setWorkflowRun(run, runs.WorkflowRuns[0])
+	return nil
+}
+
+func (d *Deployer) updateWorkflowRun(ctx context.Context, event *model.PushEvent, run *model.WorkflowRun) error {
+	r, _, err := d.actions.GetWorkflowRunByID(ctx, event.Owner, event.Repo, run.RunID)
+	if err != nil {
+		return fmt.Errorf("failed to get workflow run: %w", err)
+	}
+	setWorkflowRun(run, r)
+	return nil
+}
+
+func setWorkflowRun(run *model.WorkflowRun, r *github.WorkflowRun) {
+	run.RunID = r.GetID()
+	run.URL = r.GetHTMLURL()
+	if r.GetStatus() == "completed" {
+		run.Conclusion = r.GetConclusion()
+	}
+}
+
+// workflowRef returns the branch or tag name of the deployed ref, which is
+// what the dispatch API expects. Manual deployments of a sha and redeploys of
+// a detached HEAD have no branch or tag, and the API rejects a bare commit.
+func workflowRef(event *model.PushEvent) (string, error) {
+	ref := strings.TrimPrefix(event.Ref, "refs/heads/")
+	ref = strings.TrimPrefix(ref, "refs/tags/")
+	if ref == event.Ref && len(ref) >= 4 && strings.HasPrefix(event.AfterSha, ref) {
+		return "", fmt.Errorf("%s is a commit, not a branch or tag, so workflows can't be dispatched on it", ref)
+	}
+	return ref, nil
+}
+
+// workflowID reports whether workflow is a numeric workflow ID rather than a
+// workflow file name.
+func workflowID(workflow string) (int64, bool) {
+	id, err := strconv.ParseInt(workflow, 10, 64)
+	return id, err == nil
+}
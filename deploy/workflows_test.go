@@ -0,0 +1,137 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v68/github"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/btschwartz12/autodeploy/model"
+)
+
+// getTestGithubDeployer returns a Deployer that sends its GitHub API requests
+// to handler.
+func getTestGithubDeployer(t *testing.T, handler http.Handler) *Deployer {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+	d := New(zap.NewNop().Sugar(), "", nil)
+	d.client = client.Repositories
+	d.actions = client.Actions
+	d.checks = client.Checks
+	d.issues = client.Issues
+	return d
+}
+
+func TestTriggerWorkflows(t *testing.T) {
+	workflowPollInterval = 10 * time.Millisecond
+	start := time.Now()
+	polls := 0
+	var inputs map[string]interface{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /repos/example/repo/actions/workflows/smoke.yml/dispatches", func(w http.ResponseWriter, r *http.Request) {
+		var request github.CreateWorkflowDispatchEventRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		assert.Equal(t, "main", request.Ref)
+		inputs = request.Inputs
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /repos/example/repo/actions/workflows/missing.yml/dispatches", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	mux.HandleFunc("GET /repos/example/repo/actions/workflows/smoke.yml/runs", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "workflow_dispatch", r.URL.Query().Get("event"))
+		assert.Equal(t, "abc", r.URL.Query().Get("head_sha"))
+		// only runs created since the dispatch are ours
+		created, err := time.Parse(time.RFC3339, strings.TrimPrefix(r.URL.Query().Get("created"), ">="))
+		assert.NoError(t, err)
+		assert.False(t, created.Before(start.Truncate(time.Second)))
+		json.NewEncoder(w).Encode(map[string]any{
+			"total_count":   1,
+			"workflow_runs": []map[string]any{{"id": 7, "status": "queued", "html_url": "https://example.com/runs/7"}},
+		})
+	})
+	mux.HandleFunc("GET /repos/example/repo/actions/runs/7", func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		run := map[string]any{"id": 7, "status": "in_progress", "html_url": "https://example.com/runs/7"}
+		if polls > 1 {
+			run["status"] = "completed"
+			run["conclusion"] = "success"
+		}
+		json.NewEncoder(w).Encode(run)
+	})
+	d := getTestGithubDeployer(t, mux)
+
+	service := &model.Service{
+		Name:             "test",
+		Hostname:         "host",
+		HealthcheckURL:   "http://localhost:8080/health",
+		TriggerWorkflows: []string{"smoke.yml", "missing.yml"},
+		WaitForWorkflows: true,
+	}
+	event := &model.PushEvent{Ref: "refs/heads/main", AfterSha: "abc", Owner: "example", Repo: "repo"}
+	record := model.NewDeployment(service, event)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := d.triggerWorkflows(ctx, service, event, record)
+	assert.ErrorContains(t, err, "missing.yml")
+	assert.Equal(t, map[string]interface{}{
+		"service":         "test",
+		"host":            "host",
+		"sha":             "abc",
+		"environment_url": "http://localhost:8080/health",
+	}, inputs)
+	assert.Len(t, record.Workflows, 2)
+	assert.Equal(t, model.WorkflowRun{
+		Workflow:   "smoke.yml",
+		RunID:      7,
+		URL:        "https://example.com/runs/7",
+		Conclusion: "success",
+	}, record.Workflows[0])
+	assert.Contains(t, record.Workflows[1].Error, "404")
+}
+
+func TestWorkflowRef(t *testing.T) {
+	sha := "8e9703b922474b3d78aba29f388ea038396aab8d"
+	for ref, want := range map[string]string{
+		"refs/heads/main":  "main",
+		"refs/tags/v1.0.0": "v1.0.0",
+		"main":             "main",
+		"8e9":              "8e9",
+	} {
+		got, err := workflowRef(&model.PushEvent{Ref: ref, AfterSha: sha})
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	for _, ref := range []string{sha, "8e9703b"} {
+		_, err := workflowRef(&model.PushEvent{Ref: ref, AfterSha: sha})
+		assert.ErrorContains(t, err, "is a commit, not a branch or tag")
+	}
+}
+
+func TestTriggerWorkflowsOnCommit(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+	})
+	d := getTestGithubDeployer(t, mux)
+	service := &model.Service{Name: "test", TriggerWorkflows: []string{"smoke.yml"}}
+	event := &model.PushEvent{Ref: "abc1234", AfterSha: "abc1234def", Owner: "example", Repo: "repo"}
+	record := model.NewDeployment(service, event)
+
+	err := d.triggerWorkflows(context.Background(), service, event, record)
+	assert.ErrorContains(t, err, "abc1234 is a commit")
+	assert.Len(t, record.Workflows, 1)
+	assert.Equal(t, "smoke.yml", record.Workflows[0].Workflow)
+	assert.Equal(t, err.Error(), record.Workflows[0].Error)
+}
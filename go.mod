@@ -4,12 +4,14 @@ go 1.23.4
 
 require (
 	github.com/Netflix/go-env v0.1.2
+	github.com/fsnotify/fsnotify v1.8.0
 	github.com/go-chi/chi/v5 v5.2.0
 	github.com/go-playground/webhooks/v6 v6.4.0
 	github.com/google/go-github/v68 v68.0.0
 	github.com/google/uuid v1.6.0
 	github.com/jessevdk/go-flags v1.6.1
 	github.com/stretchr/testify v1.10.0
+	go.etcd.io/bbolt v1.3.11
 	go.uber.org/zap v1.27.0
 	gopkg.in/yaml.v3 v3.0.1
 )
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/btschwartz12/autodeploy/server"
 	flags "github.com/jessevdk/go-flags"
@@ -10,9 +14,10 @@ import (
 )
 
 type arguments struct {
-	DevLogging bool   `short:"d" long:"dev-logging" description:"Enable development logging"`
-	Port       int    `short:"p" long:"port" description:"Port to listen on" default:"8000"`
-	ConfigPath string `short:"c" long:"config" description:"Path to config file" default:"config.yaml" env:"AUTODEPLOY_CONFIG_PATH"`
+	DevLogging  bool   `short:"d" long:"dev-logging" description:"Enable development logging"`
+	Port        int    `short:"p" long:"port" description:"Port to listen on" default:"8000"`
+	ConfigPath  string `short:"c" long:"config" description:"Path to config file" default:"config.yaml" env:"AUTODEPLOY_CONFIG_PATH"`
+	WatchConfig bool   `short:"w" long:"watch-config" description:"Reload the config file when it changes" env:"AUTODEPLOY_WATCH_CONFIG"`
 }
 
 var args arguments
@@ -40,11 +45,40 @@ func main() {
 		logger.Fatalw("failed to create server", "error", err)
 	}
 
+	if err := s.Recover(); err != nil {
+		logger.Fatalw("failed to recover unfinished deliveries", "error", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	go s.WatchConfig(ctx, args.WatchConfig)
+
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf(":%d", args.Port),
+		Handler: s,
+	}
 	errChan := make(chan error)
 	go func() {
 		logger.Infow("Starting server", "port", args.Port)
-		errChan <- http.ListenAndServe(fmt.Sprintf(":%d", args.Port), s.GetRouter())
+		errChan <- httpServer.ListenAndServe()
 	}()
-	err = <-errChan
-	logger.Fatalw("http server failed", "error", err)
+	select {
+	case err = <-errChan:
+		logger.Fatalw("http server failed", "error", err)
+	case <-ctx.Done():
+	}
+	// a second signal kills the process right away
+	stop()
+
+	grace := s.GracePeriod()
+	logger.Infow("shutting down, waiting for running deployments", "grace_period", grace)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	// stop taking webhooks, without waiting for open API streams
+	go httpServer.Shutdown(shutdownCtx)
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		logger.Warnw("interrupted running deployments", "error", err)
+	}
+	logger.Infow("shut down")
 }
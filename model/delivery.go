@@ -0,0 +1,32 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type DeliveryState string
+
+const (
+	// DeliveryPending is a delivery whose deployments did not all run yet.
+	DeliveryPending   DeliveryState = "pending"
+	DeliveryDone      DeliveryState = "done"
+	DeliveryFailed    DeliveryState = "failed"
+	DeliveryAbandoned DeliveryState = "abandoned"
+	// DeliveryDuplicate is a delivery of a push another delivery brought.
+	DeliveryDuplicate DeliveryState = "duplicate"
+)
+
+// Delivery is a webhook delivery from GitHub, stored before it is
+// acknowledged so that its event survives a restart of autodeploy.
+type Delivery struct {
+	// ID is the X-GitHub-Delivery header
+	ID string `json:"id"`
+	// Event is the X-GitHub-Event header
+	Event      string          `json:"event"`
+	Payload    json.RawMessage `json:"payload"`
+	State      DeliveryState   `json:"state"`
+	Error      string          `json:"error,omitempty"`
+	ReceivedAt time.Time       `json:"received_at"`
+	FinishedAt time.Time       `json:"finished_at"`
+}
@@ -0,0 +1,92 @@
+package model
+
+import "time"
+
+type DeploymentState string
+
+const (
+	DeploymentRunning      DeploymentState = "running"
+	DeploymentSuccess      DeploymentState = "success"
+	DeploymentFailure      DeploymentState = "failure"
+	DeploymentTimeout      DeploymentState = "timeout"
+	DeploymentRolledBack   DeploymentState = "rolled_back"
+	DeploymentSuperseded   DeploymentState = "superseded"
+	DeploymentChecksFailed DeploymentState = "checks_failed"
+	DeploymentInterrupted  DeploymentState = "interrupted"
+)
+
+// Phase records when one step of a deployment (pre, activate, post, ...)
+// ran and how it ended.
+type Phase struct {
+	Name       string    `json:"name"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Error      string    `json:"error,omitempty"`
+}
+
+const (
+	OutputKindOutput = "output"
+	OutputKindPhase  = "phase"
+)
+
+// OutputLine is one line of output from a command run during a deployment,
+// or a note that a phase started or finished.
+type OutputLine struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	Text string    `json:"text"`
+}
+
+// Deployment is the persisted record of a single deployment run. Output is
+// stored apart from the rest and only loaded for a single deployment.
+type Deployment struct {
+	ID                 uint64          `json:"id"`
+	Service            string          `json:"service"`
+	Trigger            string          `json:"trigger"`
+	Ref                string          `json:"ref"`
+	Release            string          `json:"release,omitempty"`
+	Delivery           string          `json:"delivery,omitempty"`
+	BeforeSha          string          `json:"before_sha"`
+	AfterSha           string          `json:"after_sha"`
+	Pusher             string          `json:"pusher"`
+	Commits            []Commit        `json:"commits"`
+	Phases             []Phase         `json:"phases"`
+	State              DeploymentState `json:"state"`
+	Error              string          `json:"error,omitempty"`
+	GithubDeploymentID int64           `json:"github_deployment_id,omitempty"`
+	StartedAt          time.Time       `json:"started_at"`
+	FinishedAt         time.Time       `json:"finished_at"`
+	Workflows          []WorkflowRun   `json:"workflows,omitempty"`
+	Output             []OutputLine    `json:"output,omitempty"`
+}
+
+// WorkflowRun is a GitHub Actions workflow that was dispatched after a
+// successful deployment. Conclusion is only set if the run was waited for.
+type WorkflowRun struct {
+	Workflow   string `json:"workflow"`
+	RunID      int64  `json:"run_id,omitempty"`
+	URL        string `json:"url,omitempty"`
+	Conclusion string `json:"conclusion,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func NewDeployment(service *Service, event *PushEvent) *Deployment {
+	return &Deployment{
+		Service:   service.Name,
+		Trigger:   event.Trigger,
+		Ref:       event.Ref,
+		Release:   event.Release,
+		Delivery:  event.Delivery,
+		BeforeSha: event.BeforeSha,
+		AfterSha:  event.AfterSha,
+		Pusher:    event.Pusher,
+		Commits:   event.Commits,
+		Phases:    make([]Phase, 0),
+		State:     DeploymentRunning,
+		StartedAt: time.Now(),
+	}
+}
+
+func (d *Deployment) IsFinished() bool {
+	return d.State != DeploymentRunning
+}
@@ -8,32 +8,88 @@ import (
 )
 
 type Commit struct {
-	Sha       string `json:"sha"`
-	Author    string `json:"author"`
-	Committer string `json:"committer"`
-	Message   string `json:"message"`
+	Sha       string   `json:"sha"`
+	Author    string   `json:"author"`
+	Committer string   `json:"committer"`
+	Message   string   `json:"message"`
+	Added     []string `json:"added"`
+	Modified  []string `json:"modified"`
+	Removed   []string `json:"removed"`
 }
 
+const (
+	TriggerPush        = "push"
+	TriggerWorkflowRun = "workflow_run"
+	TriggerRelease     = "release"
+	TriggerTag         = "tag"
+	TriggerPullRequest = "pull_request"
+	TriggerManual      = "manual"
+	TriggerRollback    = "rollback"
+)
+
+// PushEvent describes what to deploy. BeforeSha is empty for deployments that
+// were not triggered by a push; the worktree is then reset to AfterSha, or to
+// Ref if AfterSha is empty, no matter what is checked out.
 type PushEvent struct {
-	Ref       string   `json:"ref"`
-	BeforeSha string   `json:"before"`
-	AfterSha  string   `json:"after"`
-	Forced    bool     `json:"forced"`
-	Pusher    string   `json:"pusher"`
-	Owner     string   `json:"owner"`
-	Repo      string   `json:"repo"`
-	Commits   []Commit `json:"commits"`
+	Ref           string   `json:"ref"`
+	BeforeSha     string   `json:"before"`
+	AfterSha      string   `json:"after"`
+	Forced        bool     `json:"forced"`
+	Pusher        string   `json:"pusher"`
+	Owner         string   `json:"owner"`
+	Repo          string   `json:"repo"`
+	Commits       []Commit `json:"commits"`
+	Trigger       string   `json:"trigger"`
+	Deleted       bool     `json:"deleted"`
+	DefaultBranch string   `json:"default_branch"`
+	Workflow      string   `json:"workflow,omitempty"`
+	Release       string   `json:"release,omitempty"`
+	Prerelease    bool     `json:"prerelease,omitempty"`
+	// Delivery is the webhook delivery the event came from, empty for
+	// manual deployments
+	Delivery string `json:"delivery,omitempty"`
 }
 
 func (p *PushEvent) FullRepo() string {
 	return fmt.Sprintf("%s/%s", p.Owner, p.Repo)
 }
 
+// HasCommit reports whether sha is one of the commits in the push.
+func (p *PushEvent) HasCommit(sha string) bool {
+	for _, c := range p.Commits {
+		if c.Sha == sha {
+			return true
+		}
+	}
+	return false
+}
+
+// ChangedFiles returns every file added, modified or removed by the commits
+// in the push, each listed once.
+func (p *PushEvent) ChangedFiles() []string {
+	seen := make(map[string]bool)
+	files := make([]string, 0)
+	for _, c := range p.Commits {
+		for _, list := range [][]string{c.Added, c.Modified, c.Removed} {
+			for _, file := range list {
+				if !seen[file] {
+					seen[file] = true
+					files = append(files, file)
+				}
+			}
+		}
+	}
+	return files
+}
+
 func (p *PushEvent) FromPayload(payload github.PushPayload) {
+	p.Trigger = TriggerPush
 	p.Ref = payload.Ref
 	p.BeforeSha = payload.Before
 	p.AfterSha = payload.After
 	p.Forced = payload.Forced
+	p.Deleted = payload.Deleted
+	p.DefaultBranch = payload.Repository.DefaultBranch
 	p.Pusher = payload.Pusher.Name
 	parts := strings.Split(payload.Repository.FullName, "/")
 	p.Owner = parts[0]
@@ -45,6 +101,61 @@ func (p *PushEvent) FromPayload(payload github.PushPayload) {
 			Author:    commit.Author.Username,
 			Committer: commit.Committer.Username,
 			Message:   commit.Message,
+			Added:     commit.Added,
+			Modified:  commit.Modified,
+			Removed:   commit.Removed,
 		}
 	}
 }
+
+// FromWorkflowRunPayload describes deploying the head commit of a finished
+// workflow run. The commit is checked out no matter what the worktree is at.
+func (p *PushEvent) FromWorkflowRunPayload(payload github.WorkflowRunPayload) {
+	run := payload.WorkflowRun
+	p.Trigger = TriggerWorkflowRun
+	p.Ref = "refs/heads/" + run.HeadBranch
+	p.AfterSha = run.HeadSha
+	p.DefaultBranch = payload.Repository.DefaultBranch
+	p.Workflow = payload.Workflow.Path
+	p.Pusher = payload.Sender.Login
+	parts := strings.Split(payload.Repository.FullName, "/")
+	p.Owner = parts[0]
+	p.Repo = parts[1]
+	p.Commits = []Commit{{
+		Sha:       run.HeadCommit.ID,
+		Author:    run.HeadCommit.Author.Name,
+		Committer: run.HeadCommit.Committer.Name,
+		Message:   run.HeadCommit.Message,
+	}}
+}
+
+// FromReleasePayload describes deploying the tag of a published release. The
+// tag is resolved to a commit when it is checked out.
+func (p *PushEvent) FromReleasePayload(payload github.ReleasePayload) {
+	p.Trigger = TriggerRelease
+	p.Ref = "refs/tags/" + payload.Release.TagName
+	p.Release = payload.Release.TagName
+	if payload.Release.Name != nil && *payload.Release.Name != "" {
+		p.Release = *payload.Release.Name
+	}
+	p.Prerelease = payload.Release.Prerelease
+	p.DefaultBranch = payload.Repository.DefaultBranch
+	p.Pusher = payload.Sender.Login
+	parts := strings.Split(payload.Repository.FullName, "/")
+	p.Owner = parts[0]
+	p.Repo = parts[1]
+	p.Commits = make([]Commit, 0)
+}
+
+// FromCreatePayload describes deploying a newly created tag. The tag is
+// resolved to a commit when it is checked out.
+func (p *PushEvent) FromCreatePayload(payload github.CreatePayload) {
+	p.Trigger = TriggerTag
+	p.Ref = "refs/tags/" + payload.Ref
+	p.DefaultBranch = payload.Repository.DefaultBranch
+	p.Pusher = payload.Sender.Login
+	parts := strings.Split(payload.Repository.FullName, "/")
+	p.Owner = parts[0]
+	p.Repo = parts[1]
+	p.Commits = make([]Commit, 0)
+}
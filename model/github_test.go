@@ -2,6 +2,7 @@ package model
 
 import (
 	"bytes"
+	"encoding/json"
 	"net/http/httptest"
 	"testing"
 
@@ -32,6 +33,11 @@ func TestParsePayload(t *testing.T) {
 	assert.Equal(t, "8e9703b922474b3d78aba29f388ea038396aab8d", pushEvent.AfterSha)
 	assert.Equal(t, "53272ee3b33edfe8ba8db18881f25fb9a5234288", pushEvent.BeforeSha)
 	assert.False(t, pushEvent.Forced)
+	assert.False(t, pushEvent.Deleted)
+	assert.Equal(t, "main", pushEvent.DefaultBranch)
+	assert.Equal(t, TriggerPush, pushEvent.Trigger)
+	assert.Equal(t, []string{"bruh"}, pushEvent.Commits[0].Modified)
+	assert.Equal(t, []string{"bruh"}, pushEvent.ChangedFiles())
 }
 
 const examplePayload = `
@@ -224,3 +230,133 @@ const examplePayload = `
   }
 }
 `
+
+func TestFromWorkflowRunPayload(t *testing.T) {
+	var payload github.WorkflowRunPayload
+	assert.NoError(t, json.Unmarshal([]byte(exampleWorkflowRunPayload), &payload))
+
+	event := PushEvent{}
+	event.FromWorkflowRunPayload(payload)
+
+	assert.Equal(t, TriggerWorkflowRun, event.Trigger)
+	assert.Equal(t, "refs/heads/main", event.Ref)
+	assert.Empty(t, event.BeforeSha)
+	assert.Equal(t, "8e9703b922474b3d78aba29f388ea038396aab8d", event.AfterSha)
+	assert.Equal(t, ".github/workflows/ci.yml", event.Workflow)
+	assert.Equal(t, "torvalds", event.Owner)
+	assert.Equal(t, "linux", event.Repo)
+	assert.Equal(t, "torvalds", event.Pusher)
+	assert.Equal(t, "main", event.DefaultBranch)
+	assert.Equal(t, []Commit{{
+		Sha:       "8e9703b922474b3d78aba29f388ea038396aab8d",
+		Author:    "Linus Torvalds",
+		Committer: "Linus Torvalds",
+		Message:   "y",
+	}}, event.Commits)
+}
+
+const exampleWorkflowRunPayload = `
+{
+  "action": "completed",
+  "workflow_run": {
+    "id": 42,
+    "name": "CI",
+    "head_branch": "main",
+    "head_sha": "8e9703b922474b3d78aba29f388ea038396aab8d",
+    "event": "push",
+    "status": "completed",
+    "conclusion": "success",
+    "head_commit": {
+      "id": "8e9703b922474b3d78aba29f388ea038396aab8d",
+      "message": "y",
+      "author": {"name": "Linus Torvalds", "email": "torvalds@example.com"},
+      "committer": {"name": "Linus Torvalds", "email": "torvalds@example.com"}
+    }
+  },
+  "workflow": {
+    "id": 7,
+    "name": "CI",
+    "path": ".github/workflows/ci.yml"
+  },
+  "repository": {
+    "name": "linux",
+    "full_name": "torvalds/linux",
+    "default_branch": "main"
+  },
+  "sender": {
+    "login": "torvalds"
+  }
+}
+`
+
+func TestFromReleasePayload(t *testing.T) {
+	var payload github.ReleasePayload
+	assert.NoError(t, json.Unmarshal([]byte(`{
+		"action": "published",
+		"release": {"tag_name": "v1.2.0", "name": "Spring release", "prerelease": true},
+		"repository": {"full_name": "torvalds/linux", "default_branch": "main"},
+		"sender": {"login": "torvalds"}
+	}`), &payload))
+
+	event := PushEvent{}
+	event.FromReleasePayload(payload)
+	assert.Equal(t, TriggerRelease, event.Trigger)
+	assert.Equal(t, "refs/tags/v1.2.0", event.Ref)
+	assert.Empty(t, event.AfterSha)
+	assert.Equal(t, "Spring release", event.Release)
+	assert.True(t, event.Prerelease)
+	assert.Equal(t, "torvalds", event.Pusher)
+	assert.Equal(t, "linux", event.Repo)
+
+	// releases without a name go by their tag
+	payload.Release.Name = nil
+	event.FromReleasePayload(payload)
+	assert.Equal(t, "v1.2.0", event.Release)
+}
+
+func TestFromCreatePayload(t *testing.T) {
+	var payload github.CreatePayload
+	assert.NoError(t, json.Unmarshal([]byte(`{
+		"ref": "v1.2.0",
+		"ref_type": "tag",
+		"repository": {"full_name": "torvalds/linux", "default_branch": "main"},
+		"sender": {"login": "torvalds"}
+	}`), &payload))
+
+	event := PushEvent{}
+	event.FromCreatePayload(payload)
+	assert.Equal(t, TriggerTag, event.Trigger)
+	assert.Equal(t, "refs/tags/v1.2.0", event.Ref)
+	assert.Empty(t, event.AfterSha)
+	assert.Equal(t, "torvalds", event.Owner)
+}
+
+func TestPullRequestFromPayload(t *testing.T) {
+	var payload github.PullRequestPayload
+	assert.NoError(t, json.Unmarshal([]byte(`{
+		"action": "synchronize",
+		"number": 12,
+		"pull_request": {
+			"title": "Add feature",
+			"user": {"login": "octocat"},
+			"head": {"ref": "feature", "sha": "abc", "repo": {"full_name": "torvalds/linux"}}
+		},
+		"repository": {"full_name": "torvalds/linux"}
+	}`), &payload))
+
+	pr := PullRequest{}
+	pr.FromPayload(payload)
+	assert.Equal(t, 12, pr.Number)
+	assert.Equal(t, PullRequestSynchronize, pr.Action)
+	assert.False(t, pr.FromFork)
+
+	event := pr.PushEvent()
+	assert.Equal(t, "refs/heads/feature", event.Ref)
+	assert.Equal(t, "abc", event.AfterSha)
+	assert.Empty(t, event.BeforeSha)
+	assert.Equal(t, TriggerPullRequest, event.Trigger)
+
+	payload.PullRequest.Head.Repo.FullName = "someone/linux"
+	pr.FromPayload(payload)
+	assert.True(t, pr.FromFork)
+}
@@ -0,0 +1,30 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"README.md", "README.md", true},
+		{"*.md", "README.md", true},
+		{"*.md", "docs/index.md", false},
+		{"**/*.md", "docs/index.md", true},
+		{"**/*.md", "README.md", true},
+		{"services/api/**", "services/api/main.go", true},
+		{"services/api/**", "services/api/internal/db/db.go", true},
+		{"services/api/**", "services/web/main.go", false},
+		{"services/*/Dockerfile", "services/web/Dockerfile", true},
+		{"services/**/Dockerfile", "services/Dockerfile", true},
+		{"docs", "docs/index.md", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.match, matchGlob(tt.pattern, tt.name), "%s %s", tt.pattern, tt.name)
+	}
+}
@@ -0,0 +1,60 @@
+package model
+
+import (
+	"strings"
+
+	"github.com/go-playground/webhooks/v6/github"
+)
+
+const (
+	PullRequestOpened      = "opened"
+	PullRequestReopened    = "reopened"
+	PullRequestSynchronize = "synchronize"
+	PullRequestClosed      = "closed"
+)
+
+// PullRequest describes a pull request event that a preview environment is
+// deployed or removed for.
+type PullRequest struct {
+	Number   int    `json:"number"`
+	Action   string `json:"action"`
+	Title    string `json:"title"`
+	Author   string `json:"author"`
+	HeadRef  string `json:"head_ref"`
+	HeadSha  string `json:"head_sha"`
+	Owner    string `json:"owner"`
+	Repo     string `json:"repo"`
+	FromFork bool   `json:"from_fork"`
+	Delivery string `json:"delivery,omitempty"`
+}
+
+func (pr *PullRequest) FullRepo() string {
+	return pr.Owner + "/" + pr.Repo
+}
+
+func (pr *PullRequest) FromPayload(payload github.PullRequestPayload) {
+	pr.Number = int(payload.Number)
+	pr.Action = payload.Action
+	pr.Title = payload.PullRequest.Title
+	pr.Author = payload.PullRequest.User.Login
+	pr.HeadRef = payload.PullRequest.Head.Ref
+	pr.HeadSha = payload.PullRequest.Head.Sha
+	parts := strings.Split(payload.Repository.FullName, "/")
+	pr.Owner = parts[0]
+	pr.Repo = parts[1]
+	pr.FromFork = payload.PullRequest.Head.Repo.FullName != payload.Repository.FullName
+}
+
+// PushEvent returns the event that deploys the head of the pull request. The
+// head is checked out no matter what the preview worktree is at.
+func (pr *PullRequest) PushEvent() *PushEvent {
+	return &PushEvent{
+		Ref:      "refs/heads/" + pr.HeadRef,
+		AfterSha: pr.HeadSha,
+		Pusher:   pr.Author,
+		Owner:    pr.Owner,
+		Repo:     pr.Repo,
+		Commits:  make([]Commit, 0),
+		Trigger:  TriggerPullRequest,
+	}
+}
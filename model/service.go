@@ -1,33 +1,260 @@
 package model
 
 import (
+	"cmp"
 	"fmt"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type Duration time.Duration
 
 type Service struct {
-	Name             string
-	Hostname         string   `yaml:"hostname"`
-	Repo             string   `yaml:"repo"`
-	Path             string   `yaml:"path"`
-	SystemdService   string   `yaml:"systemd_service"`
-	HealthcheckURL   string   `yaml:"healthcheck_url"`
-	ComposeService   bool     `yaml:"compose_service"`
-	NeedsSudo        bool     `yaml:"needs_sudo"`
-	BuildCommand     string   `yaml:"build_command"`
-	FlowTimeout      Duration `yaml:"flow_timeout"`
-	TriggerWorkflows []string `yaml:"trigger_workflows"`
+	Name              string
+	Hostname          string            `yaml:"hostname"`
+	Repo              string            `yaml:"repo"`
+	Trigger           string            `yaml:"trigger"`
+	Workflow          string            `yaml:"workflow"`
+	Prereleases       bool              `yaml:"prereleases"`
+	Refs              []string          `yaml:"refs"`
+	Paths             []string          `yaml:"paths"`
+	IgnorePaths       []string          `yaml:"ignore_paths"`
+	Path              string            `yaml:"path"`
+	SyncPolicy        string            `yaml:"sync_policy"`
+	Releases          *Releases         `yaml:"releases"`
+	Subdir            string            `yaml:"subdir"`
+	SharedPaths       []string          `yaml:"shared_paths"`
+	DirtyWorktree     string            `yaml:"dirty_worktree"`
+	DiscardIgnore     []string          `yaml:"discard_ignore"`
+	Order             int               `yaml:"order"`
+	Environment       string            `yaml:"environment"`
+	SystemdService    string            `yaml:"systemd_service"`
+	HealthcheckURL    string            `yaml:"healthcheck_url"`
+	Healthcheck       Healthcheck       `yaml:"healthcheck"`
+	ComposeService    bool              `yaml:"compose_service"`
+	ComposeProject    string            `yaml:"compose_project"`
+	Env               map[string]string `yaml:"env"`
+	Preview           *Preview          `yaml:"preview"`
+	NeedsSudo         bool              `yaml:"needs_sudo"`
+	BuildCommand      string            `yaml:"build_command"`
+	FlowTimeout       Duration          `yaml:"flow_timeout"`
+	RollbackOnFailure bool              `yaml:"rollback_on_failure"`
+	RequireChecks     []string          `yaml:"require_checks"`
+	ChecksTimeout     Duration          `yaml:"checks_timeout"`
+	TriggerWorkflows  []string          `yaml:"trigger_workflows"`
+	WaitForWorkflows  bool              `yaml:"wait_for_workflows"`
+	WorkflowTimeout   Duration          `yaml:"workflow_timeout"`
+}
+
+const (
+	SyncStrict      = "strict"
+	SyncFastForward = "fast-forward"
+	SyncForce       = "force"
+)
+
+// What to do with local changes in the worktree before a deployment.
+const (
+	DirtyFail            = "fail"
+	DirtyStash           = "stash"
+	DirtyDiscard         = "discard"
+	DirtyIgnoreUntracked = "ignore_untracked"
+)
+
+// Healthcheck describes when a response from HealthcheckURL counts as healthy.
+type Healthcheck struct {
+	ExpectedStatus []int    `yaml:"expected_status"`
+	BodyContains   string   `yaml:"body_contains"`
+	BodyRegex      string   `yaml:"body_regex"`
+	Interval       Duration `yaml:"interval"`
+	Successes      int      `yaml:"successes"`
+	Timeout        Duration `yaml:"timeout"`
+}
+
+// Releases turns on release mode: every deployment is exported into its own
+// directory under Path/releases, and Path/current links to the live one.
+// Keep is how many releases are kept around for rollbacks.
+type Releases struct {
+	Keep int `yaml:"keep"`
+}
+
+// Preview configures preview environments for pull requests. Each pull
+// request is checked out into its own directory under Path and started as
+// its own compose project on port BasePort plus the pull request number. URL
+// is where previews are reachable, with {port} and {number} filled in.
+type Preview struct {
+	Path     string `yaml:"path"`
+	BasePort int    `yaml:"base_port"`
+	URL      string `yaml:"url"`
 }
 
 type Config struct {
-	Hostname         string             `yaml:"hostname"`
-	GithubToken      string             `yaml:"github_token"`
-	WebhookSecret    string             `yaml:"webhook_secret"`
-	WebhookURLSuffix string             `yaml:"webhook_url_suffix"`
-	Services         map[string]Service `yaml:"services"`
+	Hostname            string             `yaml:"hostname"`
+	GithubToken         string             `yaml:"github_token"`
+	GithubTokenFile     string             `yaml:"github_token_file"`
+	WebhookSecret       string             `yaml:"webhook_secret"`
+	WebhookSecretFile   string             `yaml:"webhook_secret_file"`
+	WebhookURLSuffix    string             `yaml:"webhook_url_suffix"`
+	DatabasePath        string             `yaml:"database_path"`
+	APIToken            string             `yaml:"api_token"`
+	APITokenFile        string             `yaml:"api_token_file"`
+	ShutdownGracePeriod Duration           `yaml:"shutdown_grace_period"`
+	ResumeMaxAge        Duration           `yaml:"resume_max_age"`
+	DedupeWindow        Duration           `yaml:"dedupe_window"`
+	Services            map[string]Service `yaml:"services"`
+}
+
+// Owner returns the owner part of Repo, which is either "owner/repo" or a
+// GitHub URL.
+func (s *Service) Owner() string {
+	owner, _ := s.splitRepo()
+	return owner
+}
+
+// RepoName returns the repository part of Repo.
+func (s *Service) RepoName() string {
+	_, name := s.splitRepo()
+	return name
+}
+
+func (s *Service) splitRepo() (string, string) {
+	parts := strings.Split(strings.TrimSuffix(strings.TrimSuffix(s.Repo, "/"), ".git"), "/")
+	if len(parts) < 2 {
+		return "", s.Repo
+	}
+	return parts[len(parts)-2], parts[len(parts)-1]
+}
+
+// MatchesRef reports whether a push to ref should deploy the service. Refs
+// are matched against the service's refs globs. If there are none, services
+// triggered by releases or tags match every tag, and all others match the
+// repository's default branch.
+func (s *Service) MatchesRef(ref string, defaultBranch string) bool {
+	if len(s.Refs) == 0 && (s.Trigger == TriggerRelease || s.Trigger == TriggerTag) {
+		return strings.HasPrefix(ref, "refs/tags/")
+	}
+	if len(s.Refs) == 0 {
+		return defaultBranch == "" || ref == "refs/heads/"+defaultBranch
+	}
+	for _, pattern := range s.Refs {
+		if ok, _ := path.Match(pattern, ref); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesWorkflow reports whether a run of workflow, the path of a workflow
+// file, should deploy the service. The service's workflow is either the full
+// path or just the file name.
+func (s *Service) MatchesWorkflow(workflow string) bool {
+	return workflow == s.Workflow || path.Base(workflow) == s.Workflow
+}
+
+// MatchesFiles reports whether a push that changed files should deploy the
+// service. A file is relevant if it matches one of the paths globs, or there
+// are none, and none of the ignore_paths globs. Without any files there is no
+// telling what changed, so the service is deployed.
+func (s *Service) MatchesFiles(files []string) bool {
+	if len(files) == 0 {
+		return true
+	}
+	for _, file := range files {
+		if s.matchesFile(file) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Service) matchesFile(file string) bool {
+	for _, pattern := range s.IgnorePaths {
+		if matchGlob(pattern, file) {
+			return false
+		}
+	}
+	if len(s.Paths) == 0 {
+		return true
+	}
+	for _, pattern := range s.Paths {
+		if matchGlob(pattern, file) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsShared reports whether file, relative to the repository root, is one of
+// the service's shared paths or inside one. Shared paths are relative to the
+// subdir, and a trailing slash marks a directory.
+func (s *Service) IsShared(file string) bool {
+	for _, p := range s.SharedPaths {
+		p = path.Join(filepath.ToSlash(s.Subdir), strings.TrimSuffix(p, "/"))
+		if file == p || strings.HasPrefix(file, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// KeepsOnDiscard reports whether file, relative to the repository root, is
+// left alone when local changes are discarded.
+func (s *Service) KeepsOnDiscard(file string) bool {
+	for _, pattern := range s.DiscardIgnore {
+		if matchGlob(pattern, file) {
+			return true
+		}
+	}
+	return false
+}
+
+// PreviewService returns the service as it is deployed for the preview of
+// pull request number.
+func (s *Service) PreviewService(number int) *Service {
+	suffix := fmt.Sprintf("-pr-%d", number)
+	preview := *s
+	preview.Name = s.Name + suffix
+	preview.Path = filepath.Join(s.Preview.Path, fmt.Sprintf("pr-%d", number))
+	preview.Environment = s.Environment + suffix
+	preview.ComposeProject = strings.ToLower(s.Name) + suffix
+	preview.HealthcheckURL = s.PreviewURL(number)
+	preview.Env = make(map[string]string, len(s.Env)+2)
+	for k, v := range s.Env {
+		preview.Env[k] = v
+	}
+	preview.Env["PREVIEW_PORT"] = strconv.Itoa(s.PreviewPort(number))
+	preview.Env["PREVIEW_NUMBER"] = strconv.Itoa(number)
+	preview.Preview = nil
+	preview.Releases = nil
+	preview.RollbackOnFailure = false
+	preview.TriggerWorkflows = nil
+	return &preview
+}
+
+func (s *Service) PreviewPort(number int) int {
+	return s.Preview.BasePort + number
+}
+
+// PreviewURL returns where the preview of pull request number is reachable.
+func (s *Service) PreviewURL(number int) string {
+	url := s.Preview.URL
+	if url == "" {
+		url = "http://" + s.Hostname + ":{port}"
+	}
+	url = strings.ReplaceAll(url, "{port}", strconv.Itoa(s.PreviewPort(number)))
+	return strings.ReplaceAll(url, "{number}", strconv.Itoa(number))
+}
+
+// WorkDir is where the service's commands run. In release mode, that is in
+// the current release.
+func (s *Service) WorkDir() string {
+	if s.Releases != nil {
+		return filepath.Join(s.Path, "current", s.Subdir)
+	}
+	return filepath.Join(s.Path, s.Subdir)
 }
 
 func (s *Service) GitDir() string {
@@ -42,14 +269,22 @@ func (s *Service) HasBuildCommand() bool {
 	return s.BuildCommand != ""
 }
 
-func (c *Config) GetServiceByRepo(repo string) *Service {
-
+// GetServicesByRepo returns every service deployed from repo, ordered by
+// their order and then their name.
+func (c *Config) GetServicesByRepo(repo string) []*Service {
+	services := make([]*Service, 0)
 	for _, s := range c.Services {
 		if s.Repo == repo {
-			return &s
+			services = append(services, &s)
 		}
 	}
-	return nil
+	slices.SortFunc(services, func(a, b *Service) int {
+		if a.Order != b.Order {
+			return cmp.Compare(a.Order, b.Order)
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return services
 }
 
 func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
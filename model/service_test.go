@@ -0,0 +1,118 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchesRef(t *testing.T) {
+	s := &Service{}
+	assert.True(t, s.MatchesRef("refs/heads/main", "main"))
+	assert.False(t, s.MatchesRef("refs/heads/feature", "main"))
+	assert.False(t, s.MatchesRef("refs/tags/v1.0.0", "main"))
+
+	s.Refs = []string{"refs/heads/main", "refs/tags/v*"}
+	assert.True(t, s.MatchesRef("refs/heads/main", "main"))
+	assert.True(t, s.MatchesRef("refs/tags/v1.0.0", "main"))
+	assert.False(t, s.MatchesRef("refs/tags/release-1", "main"))
+	assert.False(t, s.MatchesRef("refs/heads/feature", "feature"))
+
+	s.Refs = []string{"refs/heads/release/*"}
+	assert.True(t, s.MatchesRef("refs/heads/release/1.x", "main"))
+	assert.False(t, s.MatchesRef("refs/heads/release/1.x/hotfix", "main"))
+
+	s = &Service{Trigger: TriggerRelease}
+	assert.True(t, s.MatchesRef("refs/tags/v1.0.0", "main"))
+	assert.False(t, s.MatchesRef("refs/heads/main", "main"))
+}
+
+func TestSplitRepo(t *testing.T) {
+	s := &Service{Repo: "torvalds/linux"}
+	assert.Equal(t, "torvalds", s.Owner())
+	assert.Equal(t, "linux", s.RepoName())
+
+	s.Repo = "https://github.com/torvalds/linux.git"
+	assert.Equal(t, "torvalds", s.Owner())
+	assert.Equal(t, "linux", s.RepoName())
+}
+
+func TestGetServicesByRepo(t *testing.T) {
+	c := &Config{
+		Services: map[string]Service{
+			"web":    {Name: "web", Repo: "example/mono"},
+			"api":    {Name: "api", Repo: "example/mono"},
+			"worker": {Name: "worker", Repo: "example/mono", Order: -1},
+			"other":  {Name: "other", Repo: "example/other"},
+		},
+	}
+	services := c.GetServicesByRepo("example/mono")
+	names := make([]string, len(services))
+	for i, s := range services {
+		names[i] = s.Name
+	}
+	assert.Equal(t, []string{"worker", "api", "web"}, names)
+	assert.Empty(t, c.GetServicesByRepo("example/missing"))
+}
+
+func TestMatchesFiles(t *testing.T) {
+	s := &Service{}
+	assert.True(t, s.MatchesFiles([]string{"README.md"}))
+	assert.True(t, s.MatchesFiles(nil))
+
+	s.IgnorePaths = []string{"**/*.md", "docs/**"}
+	assert.False(t, s.MatchesFiles([]string{"README.md", "docs/setup.txt"}))
+	assert.True(t, s.MatchesFiles([]string{"README.md", "main.go"}))
+
+	s.Paths = []string{"services/api/**", "go.mod"}
+	assert.True(t, s.MatchesFiles([]string{"services/web/main.go", "go.mod"}))
+	assert.False(t, s.MatchesFiles([]string{"services/web/main.go"}))
+	assert.False(t, s.MatchesFiles([]string{"services/api/README.md"}))
+	assert.True(t, s.MatchesFiles(nil))
+}
+
+func TestMatchesWorkflow(t *testing.T) {
+	s := &Service{Workflow: "ci.yml"}
+	assert.True(t, s.MatchesWorkflow(".github/workflows/ci.yml"))
+	assert.False(t, s.MatchesWorkflow(".github/workflows/release.yml"))
+
+	s.Workflow = ".github/workflows/ci.yml"
+	assert.True(t, s.MatchesWorkflow(".github/workflows/ci.yml"))
+}
+
+func TestPreviewService(t *testing.T) {
+	s := &Service{
+		Name:           "Web",
+		Hostname:       "myhost",
+		Path:           "/srv/web",
+		Subdir:         "app",
+		Environment:    "production",
+		ComposeService: true,
+		Env:            map[string]string{"FOO": "bar"},
+		Preview:        &Preview{Path: "/srv/previews/web", BasePort: 9000},
+	}
+	preview := s.PreviewService(12)
+	assert.Equal(t, "Web-pr-12", preview.Name)
+	assert.Equal(t, "/srv/previews/web/pr-12", preview.Path)
+	assert.Equal(t, "/srv/previews/web/pr-12/app", preview.WorkDir())
+	assert.Equal(t, "production-pr-12", preview.Environment)
+	assert.Equal(t, "web-pr-12", preview.ComposeProject)
+	assert.Equal(t, "http://myhost:9012", preview.HealthcheckURL)
+	assert.Equal(t, map[string]string{"FOO": "bar", "PREVIEW_PORT": "9012", "PREVIEW_NUMBER": "12"}, preview.Env)
+	assert.Nil(t, preview.Preview)
+	// the service itself is left alone
+	assert.Equal(t, map[string]string{"FOO": "bar"}, s.Env)
+
+	s.Preview.URL = "https://pr-{number}.preview.example.com"
+	assert.Equal(t, "https://pr-12.preview.example.com", s.PreviewURL(12))
+}
+
+func TestIsShared(t *testing.T) {
+	s := &Service{Subdir: "api", SharedPaths: []string{".env", "data/"}}
+	assert.True(t, s.IsShared("api/.env"))
+	assert.True(t, s.IsShared("api/data/db.sqlite"))
+	assert.True(t, s.IsShared("api/data"))
+	assert.False(t, s.IsShared(".env"))
+	assert.False(t, s.IsShared("api/database"))
+	assert.False(t, s.IsShared("api/main.go"))
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/btschwartz12/autodeploy/model"
+	"github.com/btschwartz12/autodeploy/store"
+)
+
+type serviceResponse struct {
+	Name           string            `json:"name"`
+	Repo           string            `json:"repo"`
+	Hostname       string            `json:"hostname"`
+	HealthcheckURL string            `json:"healthcheck_url"`
+	DeployedSha    string            `json:"deployed_sha"`
+	LastDeployment *model.Deployment `json:"last_deployment"`
+}
+
+func (s *Server) apiRoutes(r chi.Router) {
+	r.Use(s.requireAPIToken)
+	r.Get("/services", s.listServices)
+	r.Get("/deployments", s.listDeployments)
+	r.Get("/deployments/{id}", s.getDeployment)
+	r.Get("/deployments/{id}/stream", s.streamDeployment)
+	r.Post("/services/{name}/redeploy", s.redeploy)
+	r.Post("/services/{name}/deploy", s.deployRef)
+	r.Post("/services/{name}/rollback", s.rollbackTo)
+	r.Post("/deliveries/{id}/replay", s.replayDelivery)
+}
+
+func (s *Server) requireAPIToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.getConfig().APIToken)) != 1 {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) listServices(w http.ResponseWriter, r *http.Request) {
+	c := s.getConfig()
+	services := make([]serviceResponse, 0, len(c.Services))
+	for _, service := range c.Services {
+		resp := serviceResponse{
+			Name:           service.Name,
+			Repo:           service.Repo,
+			Hostname:       service.Hostname,
+			HealthcheckURL: service.HealthcheckURL,
+		}
+		sha, err := s.getDeployer().CurrentSha(&service)
+		if err != nil {
+			s.logger.Errorw("failed to get current sha", "service", service.Name, "error", err)
+		}
+		resp.DeployedSha = sha
+		last, err := s.history.LatestDeployment(service.Name)
+		if err != nil {
+			s.logger.Errorw("failed to get latest deployment", "service", service.Name, "error", err)
+			writeError(w, http.StatusInternalServerError, "failed to get latest deployment")
+			return
+		}
+		resp.LastDeployment = last
+		services = append(services, resp)
+	}
+	slices.SortFunc(services, func(a, b serviceResponse) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	writeJSON(w, http.StatusOK, services)
+}
+
+func (s *Server) listDeployments(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseDeploymentFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	deployments, err := s.history.ListDeployments(filter)
+	if err != nil {
+		s.logger.Errorw("failed to list deployments", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to list deployments")
+		return
+	}
+	writeJSON(w, http.StatusOK, deployments)
+}
+
+func (s *Server) getDeployment(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid deployment id")
+		return
+	}
+	deployment, err := s.history.GetDeployment(id)
+	if errors.Is(err, store.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "deployment not found")
+		return
+	}
+	if err != nil {
+		s.logger.Errorw("failed to get deployment", "id", id, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to get deployment")
+		return
+	}
+	deployment.Output, err = s.history.GetDeploymentOutput(id)
+	if err != nil {
+		s.logger.Errorw("failed to get deployment output", "id", id, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to get deployment output")
+		return
+	}
+	writeJSON(w, http.StatusOK, deployment)
+}
+
+func parseDeploymentFilter(r *http.Request) (store.DeploymentFilter, error) {
+	q := r.URL.Query()
+	filter := store.DeploymentFilter{
+		Service: q.Get("service"),
+		State:   model.DeploymentState(q.Get("state")),
+		Limit:   100,
+	}
+	var err error
+	if v := q.Get("since"); v != "" {
+		filter.Since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid since: %w", err)
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		filter.Until, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid until: %w", err)
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		filter.Limit, err = strconv.Atoi(v)
+		if err != nil || filter.Limit < 0 {
+			return filter, fmt.Errorf("invalid limit: %s", v)
+		}
+	}
+	return filter, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// replayDelivery handles a stored webhook delivery again, by its
+// X-GitHub-Delivery ID.
+func (s *Server) replayDelivery(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	delivery, err := s.history.GetDelivery(id)
+	if errors.Is(err, store.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "delivery not found")
+		return
+	}
+	if err != nil {
+		s.logger.Errorw("failed to get delivery", "delivery", id, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to get delivery")
+		return
+	}
+	err = s.replay(delivery)
+	if errors.Is(err, errDuplicate) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		s.logger.Errorw("failed to replay delivery", "delivery", id, "error", err)
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	delivery.Payload = nil
+	writeJSON(w, http.StatusAccepted, delivery)
+}
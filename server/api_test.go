@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/btschwartz12/autodeploy/deploy"
+	"github.com/btschwartz12/autodeploy/model"
+	"github.com/btschwartz12/autodeploy/store"
+)
+
+const testAPIToken = "test-token"
+
+func getTestServer(t *testing.T) *Server {
+	history, err := store.New(filepath.Join(t.TempDir(), "autodeploy.db"))
+	assert.NoError(t, err)
+	t.Cleanup(func() { history.Close() })
+	logger := zap.NewNop().Sugar()
+	s := &Server{
+		logger:   logger,
+		deployer: deploy.New(logger, "", history),
+		history:  history,
+		config: &model.Config{
+			APIToken:         testAPIToken,
+			WebhookURLSuffix: "/postreceive",
+			Services: map[string]model.Service{
+				"service1": {Name: "service1", Repo: "example/repo1", Path: t.TempDir()},
+				"service2": {Name: "service2", Repo: "example/repo2", Path: t.TempDir()},
+			},
+		},
+		queues: make(map[string]*deployQueue),
+	}
+	s.router = s.newRouter(s.config)
+	return s
+}
+
+func doAPIRequest(t *testing.T, s *Server, path string, v any) int {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Authorization", "Bearer "+testAPIToken)
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	if v != nil && w.Code == http.StatusOK {
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(v))
+	}
+	return w.Code
+}
+
+func TestAPIRequiresToken(t *testing.T) {
+	s := getTestServer(t)
+	for _, auth := range []string{"", "Bearer wrong", testAPIToken} {
+		req := httptest.NewRequest(http.MethodGet, "/api/services", nil)
+		req.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestAPIDeployments(t *testing.T) {
+	s := getTestServer(t)
+	for i, name := range []string{"service1", "service2", "service1"} {
+		d := model.NewDeployment(&model.Service{Name: name}, &model.PushEvent{AfterSha: name})
+		d.StartedAt = time.Date(2025, 1, 1+i, 0, 0, 0, 0, time.UTC)
+		d.State = model.DeploymentSuccess
+		if i == 2 {
+			d.State = model.DeploymentFailure
+		}
+		d.Output = []model.OutputLine{{Kind: model.OutputKindOutput, Text: "$ make build"}}
+		assert.NoError(t, s.history.CreateDeployment(d))
+	}
+
+	var deployments []model.Deployment
+	assert.Equal(t, http.StatusOK, doAPIRequest(t, s, "/api/deployments", &deployments))
+	assert.Len(t, deployments, 3)
+	assert.Equal(t, uint64(3), deployments[0].ID)
+	assert.Nil(t, deployments[0].Output)
+
+	assert.Equal(t, http.StatusOK, doAPIRequest(t, s, "/api/deployments?service=service1&state=success", &deployments))
+	assert.Len(t, deployments, 1)
+	assert.Equal(t, uint64(1), deployments[0].ID)
+
+	assert.Equal(t, http.StatusOK, doAPIRequest(t, s, "/api/deployments?since=2025-01-02T00:00:00Z&until=2025-01-02T23:00:00Z", &deployments))
+	assert.Len(t, deployments, 1)
+	assert.Equal(t, "service2", deployments[0].Service)
+
+	assert.Equal(t, http.StatusBadRequest, doAPIRequest(t, s, "/api/deployments?since=yesterday", nil))
+
+	var deployment model.Deployment
+	assert.Equal(t, http.StatusOK, doAPIRequest(t, s, "/api/deployments/2", &deployment))
+	assert.Equal(t, "service2", deployment.Service)
+	assert.Len(t, deployment.Output, 1)
+	assert.Equal(t, http.StatusNotFound, doAPIRequest(t, s, "/api/deployments/4", nil))
+
+	var services []serviceResponse
+	assert.Equal(t, http.StatusOK, doAPIRequest(t, s, "/api/services", &services))
+	assert.Len(t, services, 2)
+	assert.Equal(t, "service1", services[0].Name)
+	assert.Equal(t, model.DeploymentFailure, services[0].LastDeployment.State)
+	assert.Equal(t, "service2", services[1].Name)
+	assert.Equal(t, model.DeploymentSuccess, services[1].LastDeployment.State)
+}
+
+func TestAPIStreamFinishedDeployment(t *testing.T) {
+	s := getTestServer(t)
+	d := model.NewDeployment(&model.Service{Name: "service1"}, &model.PushEvent{AfterSha: "abc"})
+	d.State = model.DeploymentSuccess
+	d.Output = []model.OutputLine{
+		{Kind: model.OutputKindPhase, Text: "pre started"},
+		{Kind: model.OutputKindOutput, Text: "$ make build"},
+	}
+	assert.NoError(t, s.history.CreateDeployment(d))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/deployments/1/stream", nil)
+	req.Header.Set("Authorization", "Bearer "+testAPIToken)
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+
+	events := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+	assert.Len(t, events, 3)
+	assert.True(t, strings.HasPrefix(events[0], "event: phase\ndata: "))
+	assert.Contains(t, events[0], `"text":"pre started"`)
+	assert.True(t, strings.HasPrefix(events[1], "event: output\ndata: "))
+	assert.True(t, strings.HasPrefix(events[2], "event: done\ndata: "))
+	assert.Contains(t, events[2], `"state":"success"`)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/deployments/2/stream", nil)
+	req.Header.Set("Authorization", "Bearer "+testAPIToken)
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func doAPIPost(t *testing.T, s *Server, path, body string) int {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAPIToken)
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestAPIManualValidation(t *testing.T) {
+	s := getTestServer(t)
+	failed := model.NewDeployment(&model.Service{Name: "service1"}, &model.PushEvent{AfterSha: "abc"})
+	failed.State = model.DeploymentFailure
+	assert.NoError(t, s.history.CreateDeployment(failed))
+	other := model.NewDeployment(&model.Service{Name: "service2"}, &model.PushEvent{AfterSha: "def"})
+	other.State = model.DeploymentSuccess
+	assert.NoError(t, s.history.CreateDeployment(other))
+
+	assert.Equal(t, http.StatusNotFound, doAPIPost(t, s, "/api/services/nope/redeploy", ""))
+	assert.Equal(t, http.StatusBadRequest, doAPIPost(t, s, "/api/services/service1/deploy", `{}`))
+	assert.Equal(t, http.StatusBadRequest, doAPIPost(t, s, "/api/services/service1/rollback", `{}`))
+	assert.Equal(t, http.StatusNotFound, doAPIPost(t, s, "/api/services/service1/rollback", `{"deployment_id": 3}`))
+	assert.Equal(t, http.StatusBadRequest, doAPIPost(t, s, "/api/services/service1/rollback", `{"deployment_id": 1}`))
+	assert.Equal(t, http.StatusBadRequest, doAPIPost(t, s, "/api/services/service1/rollback", `{"deployment_id": 2}`))
+	// service1 is not a git repository
+	assert.Equal(t, http.StatusInternalServerError, doAPIPost(t, s, "/api/services/service1/redeploy", ""))
+
+	// nothing is queued while shutting down
+	s.draining = true
+	assert.Equal(t, http.StatusServiceUnavailable, doAPIPost(t, s, "/api/services/service1/deploy", `{"ref": "main"}`))
+}
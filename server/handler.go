@@ -1,17 +1,26 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"time"
 
+	"github.com/btschwartz12/autodeploy/deploy"
 	"github.com/btschwartz12/autodeploy/model"
 	"github.com/go-playground/webhooks/v6/github"
+	"github.com/google/uuid"
 )
 
 var supportedEvents = []github.Event{
 	github.PushEvent,
+	github.WorkflowRunEvent,
+	github.ReleaseEvent,
+	github.CreateEvent,
+	github.PullRequestEvent,
 	github.PingEvent,
 }
 
@@ -20,7 +29,15 @@ func (s *Server) health(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleWebhook(w http.ResponseWriter, r *http.Request) {
-	payload, err := s.webhook.Parse(r, supportedEvents...)
+	// keep the body to store it, Parse consumes it
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.logger.Errorw("error reading webhook", "error", err)
+		http.Error(w, "error reading webhook", http.StatusInternalServerError)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	payload, err := s.getWebhook().Parse(r, supportedEvents...)
 	if err != nil {
 		if err == github.ErrEventNotFound {
 			s.logger.Infow("event not found", "eventHeader", r.Header.Get("X-GitHub-Event"))
@@ -32,21 +49,73 @@ func (s *Server) handleWebhook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = s.handleEvent(payload)
+	delivery := &model.Delivery{
+		ID:         r.Header.Get("X-GitHub-Delivery"),
+		Event:      r.Header.Get("X-GitHub-Event"),
+		Payload:    body,
+		State:      model.DeliveryPending,
+		ReceivedAt: time.Now(),
+	}
+	if delivery.ID == "" {
+		delivery.ID = uuid.NewString()
+	}
+	// GitHub only redelivers events that were not acknowledged, so the
+	// event must be stored before it is
+	duplicate, err := s.history.CreateDelivery(delivery, s.dedupeSince())
 	if err != nil {
-		s.logger.Errorw("error handling event", "error", err)
+		s.logger.Errorw("error storing delivery", "delivery", delivery.ID, "error", err)
+		http.Error(w, "error storing delivery", http.StatusInternalServerError)
+		return
+	}
+	if duplicate {
+		s.logger.Infow("ignoring redelivery", "delivery", delivery.ID, "event", delivery.Event)
+		w.Write([]byte("duplicate"))
+		return
+	}
+
+	err = s.handleDelivery(delivery, payload)
+	if errors.Is(err, errDuplicate) {
+		s.logger.Infow("ignoring duplicate event", "delivery", delivery.ID, "error", err)
+		w.Write([]byte("duplicate"))
+		return
+	}
+	if err != nil {
+		s.logger.Errorw("error handling event", "delivery", delivery.ID, "error", err)
 		http.Error(w, "error handling event", http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
-func (s *Server) handleEvent(payload interface{}) error {
+// handleEvent queues the deployments for the payload of delivery.
+func (s *Server) handleEvent(delivery string, payload interface{}) error {
 	switch event := payload.(type) {
 	case github.PushPayload:
-		pushEvent := model.PushEvent{}
+		pushEvent := model.PushEvent{Delivery: delivery}
 		pushEvent.FromPayload(event)
 		return s.handlePushEvent(&pushEvent)
+	case github.WorkflowRunPayload:
+		return s.handleWorkflowRunEvent(delivery, event)
+	case github.ReleasePayload:
+		if event.Action != "published" {
+			s.logger.Infow("ignoring release event", "repo", event.Repository.FullName, "action", event.Action)
+			return nil
+		}
+		pushEvent := model.PushEvent{Delivery: delivery}
+		pushEvent.FromReleasePayload(event)
+		return s.handlePushEvent(&pushEvent)
+	case github.CreatePayload:
+		if event.RefType != "tag" {
+			s.logger.Infow("ignoring create event", "repo", event.Repository.FullName, "ref_type", event.RefType)
+			return nil
+		}
+		pushEvent := model.PushEvent{Delivery: delivery}
+		pushEvent.FromCreatePayload(event)
+		return s.handlePushEvent(&pushEvent)
+	case github.PullRequestPayload:
+		pr := model.PullRequest{Delivery: delivery}
+		pr.FromPayload(event)
+		return s.handlePullRequestEvent(&pr)
 	case github.PingPayload:
 		s.logger.Infow("ping event received", "repo", event.Repository.FullName, "hook", event.Hook.Name)
 		return nil
@@ -57,44 +126,332 @@ func (s *Server) handleEvent(payload interface{}) error {
 
 func (s *Server) handlePushEvent(event *model.PushEvent) error {
 	s.logger.Infow("handling push event", "event", event)
-	service := s.config.GetServiceByRepo(event.FullRepo())
-	if service == nil {
+	services := s.getConfig().GetServicesByRepo(event.FullRepo())
+	if len(services) == 0 {
 		return fmt.Errorf("service not found for repo: %s", event.Repo)
 	}
-	go s.deployAsync(service, event)
+	if event.Deleted {
+		s.logger.Infow("ignoring branch deletion", "repo", event.FullRepo(), "ref", event.Ref)
+		return nil
+	}
+	if err := s.claimPush(event); err != nil {
+		return err
+	}
+	for _, service := range services {
+		if service.Trigger != event.Trigger {
+			s.logger.Infow("ignoring event for service with other trigger", "service", service.Name, "event", event.Trigger, "trigger", service.Trigger)
+			continue
+		}
+		if event.Trigger == model.TriggerWorkflowRun && !service.MatchesWorkflow(event.Workflow) {
+			s.logger.Infow("ignoring run of other workflow", "service", service.Name, "workflow", event.Workflow)
+			continue
+		}
+		if event.Prerelease && !service.Prereleases {
+			s.logger.Infow("ignoring prerelease", "service", service.Name, "release", event.Release)
+			continue
+		}
+		if !service.MatchesRef(event.Ref, event.DefaultBranch) {
+			s.logger.Infow("ignoring push to unmatched ref", "service", service.Name, "ref", event.Ref, "refs", service.Refs)
+			continue
+		}
+		// every service gets its own copy, coalescing may change it
+		e := *event
+		if !service.MatchesFiles(e.ChangedFiles()) {
+			s.logger.Infow("ignoring push without relevant changes", "service", service.Name, "commit", e.AfterSha)
+			if err := s.getQueue(service).skip(service, &e); err != nil {
+				s.logger.Errorw("failed to record skipped push", "service", service.Name, "error", err)
+			}
+			continue
+		}
+		s.enqueue(service, &e)
+	}
+	return nil
+}
+
+// handleWorkflowRunEvent deploys the head commit of workflow runs that
+// finished successfully after a push.
+func (s *Server) handleWorkflowRunEvent(delivery string, payload github.WorkflowRunPayload) error {
+	run := payload.WorkflowRun
+	if payload.Action != "completed" || run.Conclusion != "success" || run.Event != "push" {
+		s.logger.Infow("ignoring workflow run", "repo", payload.Repository.FullName, "workflow", payload.Workflow.Path, "action", payload.Action, "conclusion", run.Conclusion, "event", run.Event)
+		return nil
+	}
+	event := model.PushEvent{Delivery: delivery}
+	event.FromWorkflowRunPayload(payload)
+	return s.handlePushEvent(&event)
+}
+
+// handlePullRequestEvent deploys or removes the preview environments of the
+// services that have them. Pull requests from forks are ignored, since their
+// code can't be trusted to run on the host.
+func (s *Server) handlePullRequestEvent(pr *model.PullRequest) error {
+	switch pr.Action {
+	case model.PullRequestOpened, model.PullRequestReopened, model.PullRequestSynchronize, model.PullRequestClosed:
+	default:
+		s.logger.Infow("ignoring pull request event", "repo", pr.FullRepo(), "pr", pr.Number, "action", pr.Action)
+		return nil
+	}
+	if pr.FromFork {
+		s.logger.Infow("ignoring pull request from fork", "repo", pr.FullRepo(), "pr", pr.Number)
+		return nil
+	}
+	for _, service := range s.getConfig().GetServicesByRepo(pr.FullRepo()) {
+		if service.Preview == nil {
+			continue
+		}
+		s.enqueuePreview(service, pr)
+	}
 	return nil
 }
 
-func (s *Server) deployAsync(service *model.Service, event *model.PushEvent) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(service.FlowTimeout))
+func (s *Server) enqueue(service *model.Service, event *model.PushEvent) {
+	q := s.getQueue(service)
+	j := &job{service: service, event: event}
+	if !deploy.NeedsChecks(service, event) {
+		s.enqueueJob(q, j)
+		return
+	}
+	// the checks are waited for while the job is queued, so they don't hold up
+	// other deployments of the worktree for up to checks_timeout
+	ctx, cancel := context.WithCancelCause(s.deployCtx)
+	j.pending = s.getDeployer().Start(service, event)
+	j.checking = true
+	j.stopChecks = cancel
+	j.checked = make(chan struct{})
+	s.enqueueJob(q, j)
+	if !s.startWorker() {
+		cancel(nil)
+		close(j.checked)
+		if q.drop(j) {
+			s.logger.Warnw("shutting down, dropping deployment", "service", service.Name)
+			s.dropJob(j)
+		}
+		return
+	}
 	go func() {
-		defer cancel()
-		err := s.deployer.Deploy(ctx, service, event)
-		if ctx.Err() == context.DeadlineExceeded {
-			s.slackClient.SendToSlack(getTimeoutMessage(service, event))
-			s.logger.Errorw("deployment timeout", "service", service.Name)
-			return
+		defer s.workers.Done()
+		defer cancel(nil)
+		s.awaitChecks(ctx, q, j)
+	}()
+}
+
+// awaitChecks waits for the required checks of the queued job j and lets it
+// take its turn once they passed. If they didn't, j is dropped.
+func (s *Server) awaitChecks(ctx context.Context, q *deployQueue, j *job) {
+	err := j.pending.WaitChecks(ctx)
+	close(j.checked)
+	if errors.Is(context.Cause(ctx), errSuperseded) {
+		return
+	}
+	if err == nil {
+		if q.ready(j) {
+			s.runQueue(q)
 		}
-		if err != nil {
-			s.slackClient.SendToSlack(getFailureMessage(service, event, err))
-			s.logger.Errorw("failed to deploy", "service", service.Name, "error", err)
-		} else {
-			s.slackClient.SendToSlack(getSuccessMessage(service, event))
-			s.logger.Infow("deployed successfully", "service", service.Name)
+		return
+	}
+	// j may have been superseded in the meantime
+	if !q.drop(j) {
+		return
+	}
+	record, err := j.pending.Finish(s.deployCtx, err)
+	s.report(j.service, j.event, record, err)
+	if s.deployCtx.Err() == nil {
+		s.jobDone(j)
+	}
+}
+
+// enqueuePreview queues pr in the queue of its preview directory, so pushes
+// to one pull request are deployed one after the other.
+func (s *Server) enqueuePreview(service *model.Service, pr *model.PullRequest) {
+	s.enqueueJob(s.getQueue(service.PreviewService(pr.Number)), &job{service: service, preview: pr})
+}
+
+func (s *Server) enqueueJob(q *deployQueue, j *job) {
+	s.addDeliveryJob(j)
+	if err := q.unskip(j); err != nil {
+		s.logger.Errorw("failed to get skipped pushes", "service", j.service.Name, "error", err)
+	}
+	start, superseded := q.push(j)
+	if superseded != nil && superseded.preview != nil {
+		s.logger.Infow("superseding queued preview", "service", j.service.Name, "pr", j.preview.Number, "action", j.preview.Action)
+	} else if superseded != nil {
+		s.logger.Infow("superseding queued deployment", "service", j.service.Name, "superseded", superseded.event.AfterSha, "by", j.event.AfterSha)
+		go s.supersede(superseded, j.event)
+	}
+	if superseded != nil {
+		s.jobDone(superseded)
+	}
+	if !start {
+		s.logger.Infow("deployment queued", "service", j.service.Name)
+		return
+	}
+	if !s.startWorker() {
+		s.logger.Warnw("shutting down, dropping deployment", "service", j.service.Name)
+		// put the queue back to idle
+		for j := q.next(); j != nil; j = q.next() {
+			s.dropJob(j)
 		}
+		return
+	}
+	go func() {
+		defer s.workers.Done()
+		s.runQueue(q)
 	}()
 }
 
-func getSuccessMessage(service *model.Service, event *model.PushEvent) (string, []string) {
+// runQueue runs the jobs of q until none is ready.
+func (s *Server) runQueue(q *deployQueue) {
+	for j := q.next(); j != nil; j = q.next() {
+		if s.isDraining() {
+			s.logger.Warnw("shutting down, dropping queued deployment", "service", j.service.Name)
+			s.dropJob(j)
+			continue
+		}
+		if j.preview != nil {
+			s.deployPreview(j.service, j.preview)
+		} else if j.pending != nil {
+			record, err := j.pending.Run(s.deployCtx, j.event)
+			s.report(j.service, j.event, record, err)
+		} else {
+			s.deploy(j.service, j.event)
+		}
+		// deliveries of interrupted jobs are resumed on the next start
+		if s.deployCtx.Err() == nil {
+			s.jobDone(j)
+		}
+	}
+}
+
+// dropJob finishes the record of a job that is dropped on shutdown. Its
+// delivery is resumed on the next start.
+func (s *Server) dropJob(j *job) {
+	if j.pending != nil {
+		j.pending.Finish(s.deployCtx, deploy.ErrInterrupted)
+	}
+}
+
+// errSuperseded stops waiting for the checks of a job that was superseded.
+var errSuperseded = errors.New("superseded")
+
+func (s *Server) supersede(superseded *job, by *model.PushEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(superseded.service.FlowTimeout))
+	defer cancel()
+	var err error
+	if superseded.pending != nil {
+		superseded.stopChecks(errSuperseded)
+		<-superseded.checked
+		err = superseded.pending.Supersede(ctx, by)
+	} else {
+		err = s.getDeployer().Supersede(ctx, superseded.service, superseded.event, by)
+	}
+	if err != nil {
+		s.logger.Errorw("failed to mark deployment as superseded", "service", superseded.service.Name, "error", err)
+	}
+}
+
+func (s *Server) deploy(service *model.Service, event *model.PushEvent) {
+	record, err := s.getDeployer().Deploy(s.deployCtx, service, event)
+	s.report(service, event, record, err)
+}
+
+// report tells Slack how the deployment of event ended.
+func (s *Server) report(service *model.Service, event *model.PushEvent, record *model.Deployment, err error) {
+	var rollbackErr *deploy.RollbackError
+	if errors.As(err, &rollbackErr) {
+		s.slackClient.SendToSlack(getRollbackMessage(service, event, rollbackErr))
+		s.logger.Errorw("failed to deploy", "service", service.Name, "error", err)
+		return
+	}
+	var checksErr *deploy.ChecksError
+	if errors.As(err, &checksErr) {
+		s.slackClient.SendToSlack(getChecksFailedMessage(service, event, checksErr))
+		s.logger.Infow("skipped deployment, required checks did not pass", "service", service.Name, "error", err)
+		return
+	}
+	if errors.Is(err, deploy.ErrInterrupted) {
+		s.slackClient.SendToSlack(getInterruptedMessage(service, event))
+		s.logger.Errorw("deployment interrupted", "service", service.Name)
+		return
+	}
+	if errors.Is(err, deploy.ErrTimeout) {
+		s.slackClient.SendToSlack(getTimeoutMessage(service, event))
+		s.logger.Errorw("deployment timeout", "service", service.Name)
+		return
+	}
+	if err != nil {
+		s.slackClient.SendToSlack(getFailureMessage(service, event, err))
+		s.logger.Errorw("failed to deploy", "service", service.Name, "error", err)
+	} else {
+		s.slackClient.SendToSlack(getSuccessMessage(service, event, record.Workflows))
+		s.logger.Infow("deployed successfully", "service", service.Name)
+	}
+}
+
+func (s *Server) deployPreview(service *model.Service, pr *model.PullRequest) {
+	ctx, cancel := context.WithTimeout(s.deployCtx, time.Duration(service.FlowTimeout))
+	defer cancel()
+	if pr.Action == model.PullRequestClosed {
+		err := s.getDeployer().RemovePreview(ctx, service, pr)
+		if err != nil {
+			s.logger.Errorw("failed to remove preview", "service", service.Name, "pr", pr.Number, "error", err)
+		}
+		return
+	}
+	url, err := s.getDeployer().DeployPreview(ctx, service, pr)
+	if err != nil {
+		s.slackClient.SendToSlack(getPreviewFailureMessage(service, pr, err))
+		s.logger.Errorw("failed to deploy preview", "service", service.Name, "pr", pr.Number, "error", err)
+		return
+	}
+	s.slackClient.SendToSlack(getPreviewMessage(service, pr, url))
+	s.logger.Infow("deployed preview", "service", service.Name, "pr", pr.Number, "url", url)
+}
+
+func getPreviewMessage(service *model.Service, pr *model.PullRequest, url string) (string, []string) {
+	title := fmt.Sprintf("🔎 deployed preview of `%s` for #%d 🔎", service.Name, pr.Number)
+	followUps := make([]string, 0)
+	followUps = append(followUps, fmt.Sprintf("pull request: `%s` by `%s`", pr.Title, pr.Author))
+	followUps = append(followUps, fmt.Sprintf("commit: `%s`", pr.HeadSha))
+	followUps = append(followUps, fmt.Sprintf("url: `%s`", url))
+	return title, followUps
+}
+
+func getPreviewFailureMessage(service *model.Service, pr *model.PullRequest, err error) (string, []string) {
+	title := fmt.Sprintf("❌ failed to deploy preview of `%s` for #%d ❌", service.Name, pr.Number)
+	followUps := make([]string, 0)
+	followUps = append(followUps, fmt.Sprintf("pull request: `%s` by `%s`", pr.Title, pr.Author))
+	followUps = append(followUps, fmt.Sprintf("commit: `%s`", pr.HeadSha))
+	followUps = append(followUps, fmt.Sprintf("error: \n```%s```", err.Error()))
+	return title, followUps
+}
+
+func getSuccessMessage(service *model.Service, event *model.PushEvent, workflows []model.WorkflowRun) (string, []string) {
 	title := fmt.Sprintf("✅ successfully deployed `%s` ✅", service.Name)
 	followUps := make([]string, 0)
 	followUps = append(followUps, fmt.Sprintf("host: `%s`", service.Hostname))
 	followUps = append(followUps, fmt.Sprintf("repo: `%s`", service.Repo))
 	followUps = append(followUps, fmt.Sprintf("url: `%s`", service.HealthcheckURL))
 	followUps = append(followUps, fmt.Sprintf("commit: `%s`", event.AfterSha))
+	followUps = appendTrigger(followUps, event)
+	for _, run := range workflows {
+		followUps = append(followUps, getWorkflowMessage(run))
+	}
 	return title, followUps
 }
 
+func getWorkflowMessage(run model.WorkflowRun) string {
+	switch {
+	case run.Error != "":
+		return fmt.Sprintf("workflow `%s`: ❌ %s", run.Workflow, run.Error)
+	case run.Conclusion == "":
+		return fmt.Sprintf("workflow `%s`: dispatched", run.Workflow)
+	case run.Conclusion == "success":
+		return fmt.Sprintf("workflow `%s`: ✅ %s", run.Workflow, run.URL)
+	default:
+		return fmt.Sprintf("workflow `%s`: ❌ %s %s", run.Workflow, run.Conclusion, run.URL)
+	}
+}
+
 func getFailureMessage(service *model.Service, event *model.PushEvent, err error) (string, []string) {
 	title := fmt.Sprintf("❌ failed to deploy `%s` ❌", service.Name)
 	followUps := make([]string, 0)
@@ -102,6 +459,35 @@ func getFailureMessage(service *model.Service, event *model.PushEvent, err error
 	followUps = append(followUps, fmt.Sprintf("repo: `%s`", service.Repo))
 	followUps = append(followUps, fmt.Sprintf("commit: `%s`", event.AfterSha))
 	followUps = append(followUps, fmt.Sprintf("error: \n```%s```", err.Error()))
+	followUps = appendTrigger(followUps, event)
+	return title, followUps
+}
+
+func getRollbackMessage(service *model.Service, event *model.PushEvent, err *deploy.RollbackError) (string, []string) {
+	title := fmt.Sprintf("⏪ failed to deploy `%s`, rolled back to `%s` ⏪", service.Name, err.Sha)
+	if err.RollbackErr != nil {
+		title = fmt.Sprintf("❌ failed to deploy `%s`, rollback to `%s` failed ❌", service.Name, err.Sha)
+	}
+	followUps := make([]string, 0)
+	followUps = append(followUps, fmt.Sprintf("host: `%s`", service.Hostname))
+	followUps = append(followUps, fmt.Sprintf("repo: `%s`", service.Repo))
+	followUps = append(followUps, fmt.Sprintf("commit: `%s`", event.AfterSha))
+	followUps = append(followUps, fmt.Sprintf("error: \n```%s```", err.Err.Error()))
+	if err.RollbackErr != nil {
+		followUps = append(followUps, fmt.Sprintf("rollback error: \n```%s```", err.RollbackErr.Error()))
+	}
+	followUps = appendTrigger(followUps, event)
+	return title, followUps
+}
+
+func getChecksFailedMessage(service *model.Service, event *model.PushEvent, err *deploy.ChecksError) (string, []string) {
+	title := fmt.Sprintf("🚦 skipped deploying `%s`, required checks did not pass 🚦", service.Name)
+	followUps := make([]string, 0)
+	followUps = append(followUps, fmt.Sprintf("host: `%s`", service.Hostname))
+	followUps = append(followUps, fmt.Sprintf("repo: `%s`", service.Repo))
+	followUps = append(followUps, fmt.Sprintf("commit: `%s`", event.AfterSha))
+	followUps = append(followUps, fmt.Sprintf("error: \n```%s```", err.Error()))
+	followUps = appendTrigger(followUps, event)
 	return title, followUps
 }
 
@@ -111,5 +497,26 @@ func getTimeoutMessage(service *model.Service, event *model.PushEvent) (string,
 	followUps = append(followUps, fmt.Sprintf("host: `%s`", service.Hostname))
 	followUps = append(followUps, fmt.Sprintf("repo: `%s`", service.Repo))
 	followUps = append(followUps, fmt.Sprintf("commit: `%s`", event.AfterSha))
+	followUps = appendTrigger(followUps, event)
+	return title, followUps
+}
+
+func getInterruptedMessage(service *model.Service, event *model.PushEvent) (string, []string) {
+	title := fmt.Sprintf("⚠️ deployment of `%s` interrupted by shutdown ⚠️", service.Name)
+	followUps := make([]string, 0)
+	followUps = append(followUps, fmt.Sprintf("host: `%s`", service.Hostname))
+	followUps = append(followUps, fmt.Sprintf("repo: `%s`", service.Repo))
+	followUps = append(followUps, fmt.Sprintf("commit: `%s`", event.AfterSha))
+	followUps = appendTrigger(followUps, event)
 	return title, followUps
 }
+
+func appendTrigger(followUps []string, event *model.PushEvent) []string {
+	if event.Release != "" {
+		followUps = append(followUps, fmt.Sprintf("release: `%s`", event.Release))
+	}
+	if event.Trigger == model.TriggerPush {
+		return followUps
+	}
+	return append(followUps, fmt.Sprintf("trigger: `%s` by `%s` (ref `%s`)", event.Trigger, event.Pusher, event.Ref))
+}
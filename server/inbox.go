@@ -0,0 +1,226 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-playground/webhooks/v6/github"
+
+	"github.com/btschwartz12/autodeploy/model"
+	"github.com/btschwartz12/autodeploy/store"
+)
+
+// deliveryRetention is how long finished deliveries are kept for replaying.
+const deliveryRetention = 30 * 24 * time.Hour
+
+// errDuplicate is returned for events that another delivery already brought.
+var errDuplicate = errors.New("duplicate")
+
+// dedupeSince is when the dedupe window starts: deliveries and pushes seen
+// before it are handled again.
+func (s *Server) dedupeSince() time.Time {
+	return time.Now().Add(-time.Duration(s.getConfig().DedupeWindow))
+}
+
+// claimPush makes sure only one delivery within the dedupe window deploys a
+// push, like a push and its redelivery under a new ID. The event kind, ref,
+// workflow, release and before sha are part of the key, so a tag or another
+// workflow's run for the same commit, or a force push back to it, are
+// deployed as usual.
+func (s *Server) claimPush(event *model.PushEvent) error {
+	if event.Delivery == "" {
+		return nil
+	}
+	key := strings.Join([]string{
+		event.FullRepo(),
+		event.Trigger,
+		event.Ref,
+		event.Workflow,
+		event.Release,
+		event.BeforeSha,
+		event.AfterSha,
+	}, " ")
+	owner, err := s.history.ClaimPush(key, event.Delivery, s.dedupeSince())
+	if err != nil {
+		return fmt.Errorf("failed to check for duplicates: %w", err)
+	}
+	if owner != "" {
+		return fmt.Errorf("%w of delivery %s", errDuplicate, owner)
+	}
+	return nil
+}
+
+// handleDelivery queues the deployments for a stored delivery. The delivery
+// is finished once all of them ran, or right away if there are none.
+func (s *Server) handleDelivery(d *model.Delivery, payload interface{}) error {
+	// hold the delivery open until all of its jobs are queued
+	s.trackDelivery(d.ID, 1)
+	err := s.handleEvent(d.ID, payload)
+	if s.trackDelivery(d.ID, -1) {
+		s.finishDelivery(d.ID, err)
+	}
+	return err
+}
+
+// trackDelivery adds n to the number of unfinished jobs of a delivery, and
+// reports whether that leaves none.
+func (s *Server) trackDelivery(id string, n int) bool {
+	s.deliveriesMu.Lock()
+	defer s.deliveriesMu.Unlock()
+	if s.deliveryJobs == nil {
+		s.deliveryJobs = make(map[string]int)
+	}
+	s.deliveryJobs[id] += n
+	if s.deliveryJobs[id] > 0 {
+		return false
+	}
+	delete(s.deliveryJobs, id)
+	return true
+}
+
+func (s *Server) addDeliveryJob(j *job) {
+	if id := j.delivery(); id != "" {
+		s.trackDelivery(id, 1)
+	}
+}
+
+// jobDone finishes the delivery of j if it was its last unfinished job.
+func (s *Server) jobDone(j *job) {
+	if id := j.delivery(); id != "" && s.trackDelivery(id, -1) {
+		s.finishDelivery(id, nil)
+	}
+}
+
+func (s *Server) finishDelivery(id string, err error) {
+	d, getErr := s.history.GetDelivery(id)
+	if getErr != nil {
+		s.logger.Errorw("failed to get delivery", "delivery", id, "error", getErr)
+		return
+	}
+	d.State = model.DeliveryDone
+	if errors.Is(err, errDuplicate) {
+		d.State = model.DeliveryDuplicate
+		d.Error = err.Error()
+	} else if err != nil {
+		d.State = model.DeliveryFailed
+		d.Error = err.Error()
+	}
+	d.FinishedAt = time.Now()
+	if err := s.history.SaveDelivery(d); err != nil {
+		s.logger.Errorw("failed to save delivery", "delivery", id, "error", err)
+	}
+}
+
+// replay handles a stored delivery again, whatever state it is in.
+func (s *Server) replay(d *model.Delivery) error {
+	payload, err := parsePayload(d.Event, d.Payload)
+	if err != nil {
+		return err
+	}
+	d.State = model.DeliveryPending
+	d.Error = ""
+	d.FinishedAt = time.Time{}
+	if err := s.history.SaveDelivery(d); err != nil {
+		return fmt.Errorf("failed to save delivery: %w", err)
+	}
+	s.logger.Infow("replaying delivery", "delivery", d.ID, "event", d.Event, "received_at", d.ReceivedAt)
+	return s.handleDelivery(d, payload)
+}
+
+// Recover picks up what autodeploy left unfinished when it last stopped.
+// Deployments still recorded as running were cut off, so they are marked as
+// interrupted. Pending deliveries are handled again, oldest first, unless
+// they were received more than resume_max_age ago: deploying a push that
+// late would surprise whoever made it, so those are abandoned, and can still
+// be replayed through the API.
+func (s *Server) Recover() error {
+	running, err := s.history.ListDeployments(store.DeploymentFilter{State: model.DeploymentRunning})
+	if err != nil {
+		return fmt.Errorf("failed to list running deployments: %w", err)
+	}
+	for _, d := range running {
+		d.State = model.DeploymentInterrupted
+		d.Error = "autodeploy stopped during the deployment"
+		d.FinishedAt = time.Now()
+		if err := s.history.UpdateDeployment(&d); err != nil {
+			return fmt.Errorf("failed to update deployment %d: %w", d.ID, err)
+		}
+		s.logger.Warnw("marked deployment as interrupted", "service", d.Service, "id", d.ID)
+	}
+
+	// redeliveries must still be recognized as such
+	retention := max(deliveryRetention, time.Duration(s.getConfig().DedupeWindow))
+	pruned, err := s.history.PruneDeliveries(time.Now().Add(-retention))
+	if err != nil {
+		return fmt.Errorf("failed to prune deliveries: %w", err)
+	}
+	if pruned > 0 {
+		s.logger.Infow("pruned old deliveries", "count", pruned)
+	}
+	if _, err := s.history.PrunePushes(s.dedupeSince()); err != nil {
+		return fmt.Errorf("failed to prune pushes: %w", err)
+	}
+
+	pending, err := s.history.ListDeliveries(model.DeliveryPending)
+	if err != nil {
+		return fmt.Errorf("failed to list pending deliveries: %w", err)
+	}
+	maxAge := time.Duration(s.getConfig().ResumeMaxAge)
+	abandoned := make([]string, 0)
+	for _, d := range pending {
+		if time.Since(d.ReceivedAt) > maxAge {
+			d.State = model.DeliveryAbandoned
+			d.FinishedAt = time.Now()
+			if err := s.history.SaveDelivery(&d); err != nil {
+				return fmt.Errorf("failed to save delivery: %w", err)
+			}
+			s.logger.Warnw("abandoned delivery", "delivery", d.ID, "event", d.Event, "received_at", d.ReceivedAt)
+			abandoned = append(abandoned, fmt.Sprintf("`%s` (%s, received %s)", d.ID, d.Event, d.ReceivedAt.Format(time.RFC3339)))
+			continue
+		}
+		s.logger.Infow("resuming delivery", "delivery", d.ID, "event", d.Event, "received_at", d.ReceivedAt)
+		if err := s.replay(&d); err != nil {
+			s.logger.Errorw("failed to resume delivery", "delivery", d.ID, "error", err)
+			s.finishDelivery(d.ID, err)
+		}
+	}
+	if len(abandoned) > 0 {
+		s.slackClient.SendToSlack(
+			fmt.Sprintf("⚠️ abandoned %d webhook deliveries older than %s ⚠️", len(abandoned), maxAge),
+			abandoned,
+		)
+	}
+	return nil
+}
+
+// parsePayload decodes the payload of a stored delivery the way the webhook
+// does, without checking its signature again.
+func parsePayload(event string, body []byte) (interface{}, error) {
+	switch github.Event(event) {
+	case github.PushEvent:
+		return unmarshalPayload[github.PushPayload](body)
+	case github.WorkflowRunEvent:
+		return unmarshalPayload[github.WorkflowRunPayload](body)
+	case github.ReleaseEvent:
+		return unmarshalPayload[github.ReleasePayload](body)
+	case github.CreateEvent:
+		return unmarshalPayload[github.CreatePayload](body)
+	case github.PullRequestEvent:
+		return unmarshalPayload[github.PullRequestPayload](body)
+	case github.PingEvent:
+		return unmarshalPayload[github.PingPayload](body)
+	default:
+		return nil, fmt.Errorf("unsupported event type: %s", event)
+	}
+}
+
+func unmarshalPayload[T any](body []byte) (interface{}, error) {
+	var payload T
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("failed to parse payload: %w", err)
+	}
+	return payload, nil
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/btschwartz12/autodeploy/model"
+	"github.com/btschwartz12/autodeploy/store"
+)
+
+const (
+	testPingPayload  = `{"zen":"hi","repository":{"full_name":"example/repo1"}}`
+	testOtherRefPush = `{"ref":"refs/heads/other","repository":{"full_name":"example/repo1","default_branch":"main"}}`
+	testUnknownPush  = `{"ref":"refs/heads/main","repository":{"full_name":"example/unknown","default_branch":"main"}}`
+)
+
+func getTestInboxServer(t *testing.T) *Server {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestConfig(t, path, "/postreceive", "token1")
+	s, err := NewServer(zap.NewNop().Sugar(), path)
+	assert.NoError(t, err)
+	t.Cleanup(func() { s.history.Close() })
+	return s
+}
+
+// sendWebhook posts a webhook signed with the secret from writeTestConfig.
+func sendWebhook(s *Server, delivery, event, body string) *httptest.ResponseRecorder {
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(body))
+	req := httptest.NewRequest(http.MethodPost, "/postreceive", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", event)
+	req.Header.Set("X-GitHub-Delivery", delivery)
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	return w
+}
+
+func getDeliveryState(t *testing.T, s *Server, id string) model.DeliveryState {
+	d, err := s.history.GetDelivery(id)
+	assert.NoError(t, err)
+	return d.State
+}
+
+func TestWebhookStoresDelivery(t *testing.T) {
+	s := getTestInboxServer(t)
+
+	assert.Equal(t, http.StatusOK, sendWebhook(s, "ping-1", "ping", testPingPayload).Code)
+	d, err := s.history.GetDelivery("ping-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", d.Event)
+	assert.JSONEq(t, testPingPayload, string(d.Payload))
+	assert.Equal(t, model.DeliveryDone, d.State)
+
+	assert.Equal(t, http.StatusInternalServerError, sendWebhook(s, "push-1", "push", testUnknownPush).Code)
+	d, err = s.history.GetDelivery("push-1")
+	assert.NoError(t, err)
+	assert.Equal(t, model.DeliveryFailed, d.State)
+	assert.Equal(t, "service not found for repo: unknown", d.Error)
+
+	// a forged delivery is not stored
+	req := httptest.NewRequest(http.MethodPost, "/postreceive", bytes.NewBufferString(testOtherRefPush))
+	req.Header.Set("X-GitHub-Event", "push")
+	req.Header.Set("X-GitHub-Delivery", "push-2")
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString([]byte("forged")))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	_, err = s.history.GetDelivery("push-2")
+	assert.ErrorIs(t, err, store.ErrNotFound)
+}
+
+func TestWebhookDuplicates(t *testing.T) {
+	s := getTestInboxServer(t)
+
+	w := sendWebhook(s, "ping-1", "ping", testPingPayload)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Body.String())
+	w = sendWebhook(s, "ping-1", "ping", testPingPayload)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "duplicate", w.Body.String())
+
+	// the same push under another delivery ID
+	assert.Empty(t, sendWebhook(s, "push-1", "push", testOtherRefPush).Body.String())
+	w = sendWebhook(s, "push-2", "push", testOtherRefPush)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "duplicate", w.Body.String())
+	d, err := s.history.GetDelivery("push-2")
+	assert.NoError(t, err)
+	assert.Equal(t, model.DeliveryDuplicate, d.State)
+	assert.Equal(t, "duplicate of delivery push-1", d.Error)
+
+	// a failed delivery may be redelivered
+	assert.Equal(t, http.StatusInternalServerError, sendWebhook(s, "push-3", "push", testUnknownPush).Code)
+	assert.Equal(t, http.StatusInternalServerError, sendWebhook(s, "push-3", "push", testUnknownPush).Code)
+}
+
+func TestWebhookDuplicateWorkflowRuns(t *testing.T) {
+	s := getTestInboxServer(t)
+	run := func(workflow string) string {
+		return fmt.Sprintf(`{
+			"action": "completed",
+			"workflow": {"path": %q},
+			"workflow_run": {"conclusion": "success", "event": "push", "head_branch": "main", "head_sha": "abc"},
+			"repository": {"full_name": "example/repo1", "default_branch": "main"}
+		}`, workflow)
+	}
+
+	// two workflows finishing on the same commit are not duplicates
+	assert.Empty(t, sendWebhook(s, "run-1", "workflow_run", run(".github/workflows/lint.yml")).Body.String())
+	assert.Empty(t, sendWebhook(s, "run-2", "workflow_run", run(".github/workflows/ci.yml")).Body.String())
+	assert.Equal(t, "duplicate", sendWebhook(s, "run-3", "workflow_run", run(".github/workflows/ci.yml")).Body.String())
+}
+
+func TestDeliveryFinishesWithLastJob(t *testing.T) {
+	s := getTestInboxServer(t)
+	assert.NoError(t, s.history.SaveDelivery(&model.Delivery{ID: "push-1", State: model.DeliveryPending}))
+	first := &job{event: &model.PushEvent{Delivery: "push-1"}}
+	second := &job{event: &model.PushEvent{Delivery: "push-1"}}
+	s.addDeliveryJob(first)
+	s.addDeliveryJob(second)
+
+	s.jobDone(first)
+	assert.Equal(t, model.DeliveryPending, getDeliveryState(t, s, "push-1"))
+	s.jobDone(second)
+	assert.Equal(t, model.DeliveryDone, getDeliveryState(t, s, "push-1"))
+
+	// manual jobs have no delivery
+	s.addDeliveryJob(&job{event: &model.PushEvent{}})
+	s.jobDone(&job{event: &model.PushEvent{}})
+}
+
+func TestRecover(t *testing.T) {
+	s := getTestInboxServer(t)
+	deliveries := []*model.Delivery{
+		{ID: "old", Event: "push", Payload: []byte(testOtherRefPush), ReceivedAt: time.Now().Add(-2 * time.Hour)},
+		{ID: "recent", Event: "push", Payload: []byte(testOtherRefPush), ReceivedAt: time.Now().Add(-time.Minute)},
+		{ID: "broken", Event: "push", Payload: []byte(`[]`), ReceivedAt: time.Now().Add(-time.Minute)},
+	}
+	for _, d := range deliveries {
+		d.State = model.DeliveryPending
+		assert.NoError(t, s.history.SaveDelivery(d))
+	}
+	running := model.NewDeployment(&model.Service{Name: "service1"}, &model.PushEvent{})
+	assert.NoError(t, s.history.CreateDeployment(running))
+
+	assert.NoError(t, s.Recover())
+	assert.Equal(t, model.DeliveryAbandoned, getDeliveryState(t, s, "old"))
+	assert.Equal(t, model.DeliveryDone, getDeliveryState(t, s, "recent"))
+	assert.Equal(t, model.DeliveryFailed, getDeliveryState(t, s, "broken"))
+	d, err := s.history.GetDeployment(running.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, model.DeploymentInterrupted, d.State)
+}
+
+func TestAPIReplayDelivery(t *testing.T) {
+	s := getTestInboxServer(t)
+	s.config.APIToken = testAPIToken
+	s.router = s.newRouter(s.config)
+	assert.Equal(t, http.StatusOK, sendWebhook(s, "push-1", "push", testOtherRefPush).Code)
+
+	replay := func(id string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/deliveries/"+id+"/replay", nil)
+		req.Header.Set("Authorization", "Bearer "+testAPIToken)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusNotFound, replay("unknown"))
+	assert.Equal(t, http.StatusAccepted, replay("push-1"))
+	d, err := s.history.GetDelivery("push-1")
+	assert.NoError(t, err)
+	assert.Equal(t, model.DeliveryDone, d.State)
+
+	// a duplicate stays one
+	assert.Equal(t, "duplicate", sendWebhook(s, "push-2", "push", testOtherRefPush).Body.String())
+	assert.Equal(t, http.StatusConflict, replay("push-2"))
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/btschwartz12/autodeploy/model"
+	"github.com/btschwartz12/autodeploy/store"
+)
+
+const manualPusher = "api"
+
+type deployRequest struct {
+	Ref string `json:"ref"`
+}
+
+type rollbackRequest struct {
+	DeploymentID uint64 `json:"deployment_id"`
+}
+
+type queuedResponse struct {
+	Status  string `json:"status"`
+	Service string `json:"service"`
+	Ref     string `json:"ref"`
+	Sha     string `json:"sha,omitempty"`
+}
+
+// redeploy runs the pipeline again for whatever is currently checked out.
+func (s *Server) redeploy(w http.ResponseWriter, r *http.Request) {
+	service := s.getService(w, r)
+	if service == nil {
+		return
+	}
+	ref, sha, err := s.getDeployer().CurrentRef(service)
+	if err != nil {
+		s.logger.Errorw("failed to get current ref", "service", service.Name, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to get current ref")
+		return
+	}
+	s.enqueueManual(w, service, model.TriggerManual, ref, sha)
+}
+
+// deployRef deploys a sha, tag or branch of the service's repository.
+func (s *Server) deployRef(w http.ResponseWriter, r *http.Request) {
+	service := s.getService(w, r)
+	if service == nil {
+		return
+	}
+	var req deployRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Ref == "" {
+		writeError(w, http.StatusBadRequest, "ref must be set")
+		return
+	}
+	s.enqueueManual(w, service, model.TriggerManual, req.Ref, "")
+}
+
+// rollbackTo deploys the commit of an earlier successful deployment.
+func (s *Server) rollbackTo(w http.ResponseWriter, r *http.Request) {
+	service := s.getService(w, r)
+	if service == nil {
+		return
+	}
+	var req rollbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.DeploymentID == 0 {
+		writeError(w, http.StatusBadRequest, "deployment_id must be set")
+		return
+	}
+	deployment, err := s.history.GetDeployment(req.DeploymentID)
+	if errors.Is(err, store.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "deployment not found")
+		return
+	}
+	if err != nil {
+		s.logger.Errorw("failed to get deployment", "id", req.DeploymentID, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to get deployment")
+		return
+	}
+	if deployment.Service != service.Name {
+		writeError(w, http.StatusBadRequest, "deployment belongs to a different service")
+		return
+	}
+	if deployment.State != model.DeploymentSuccess {
+		writeError(w, http.StatusBadRequest, "can only roll back to a successful deployment")
+		return
+	}
+	s.enqueueManual(w, service, model.TriggerRollback, deployment.Ref, deployment.AfterSha)
+}
+
+func (s *Server) getService(w http.ResponseWriter, r *http.Request) *model.Service {
+	name := chi.URLParam(r, "name")
+	service, ok := s.getConfig().Services[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, "service not found")
+		return nil
+	}
+	return &service
+}
+
+func (s *Server) enqueueManual(w http.ResponseWriter, service *model.Service, trigger, ref, sha string) {
+	// the job would be dropped
+	if s.isDraining() {
+		writeError(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+	event := &model.PushEvent{
+		Ref:      ref,
+		AfterSha: sha,
+		Pusher:   manualPusher,
+		Owner:    service.Owner(),
+		Repo:     service.RepoName(),
+		Commits:  make([]model.Commit, 0),
+		Trigger:  trigger,
+	}
+	s.logger.Infow("manual deployment requested", "service", service.Name, "trigger", trigger, "ref", ref, "sha", sha)
+	s.enqueue(service, event)
+	writeJSON(w, http.StatusAccepted, queuedResponse{
+		Status:  "queued",
+		Service: service.Name,
+		Ref:     ref,
+		Sha:     sha,
+	})
+}
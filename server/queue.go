@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/btschwartz12/autodeploy/deploy"
+	"github.com/btschwartz12/autodeploy/model"
+	"github.com/btschwartz12/autodeploy/store"
+)
+
+// job is either a deployment of event, or a deployment or removal of the
+// preview environment for a pull request.
+type job struct {
+	service *model.Service
+	event   *model.PushEvent
+	preview *model.PullRequest
+	// pending is set for deployments that wait for their required checks
+	// while queued, and checking is true until the checks passed. stopChecks
+	// stops the wait and checked is closed once it ended.
+	pending    *deploy.Pending
+	checking   bool
+	stopChecks context.CancelCauseFunc
+	checked    chan struct{}
+}
+
+// delivery returns the webhook delivery j came from, empty for manual jobs.
+func (j *job) delivery() string {
+	if j.preview != nil {
+		return j.preview.Delivery
+	}
+	return j.event.Delivery
+}
+
+// deployQueue makes sure only one deployment per git worktree runs at a
+// time, so services that share a repository checkout never step on each
+// other. Jobs run in the order they were pushed, skipping jobs that still
+// wait for their required checks. A job for a service that already has one
+// pending replaces it, so only the newest push for each service is deployed
+// next.
+type deployQueue struct {
+	mu      sync.Mutex
+	running bool
+	pending []*job
+	// history holds the pushes per service that were not deployed because
+	// they did not touch any of its paths, so they survive a restart
+	history *store.Store
+}
+
+// skip records a push that is not deployed for service. The next push for
+// the service picks up its commits, since the worktree was not moved past it.
+func (q *deployQueue) skip(service *model.Service, event *model.PushEvent) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	skipped, err := q.history.SkippedPush(service.Name)
+	if err != nil {
+		return err
+	}
+	if skipped != nil {
+		event = mergeEvents(skipped, event)
+	}
+	return q.history.SaveSkippedPush(service.Name, event)
+}
+
+// unskip puts the pushes skipped for the service of j in front of it, so that
+// j deploys their commits too.
+func (q *deployQueue) unskip(j *job) error {
+	if j.event == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	skipped, err := q.history.SkippedPush(j.service.Name)
+	if err != nil || skipped == nil {
+		return err
+	}
+	if err := q.history.DeleteSkippedPush(j.service.Name); err != nil {
+		return err
+	}
+	j.event = mergeEvents(skipped, j.event)
+	return nil
+}
+
+// push adds j to the queue, replacing any pending job for the same service,
+// which is returned as superseded. If nothing is running and a job is ready,
+// start is true and the caller is responsible for draining the queue with
+// next.
+func (q *deployQueue) push(j *job) (start bool, superseded *job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := slices.IndexFunc(q.pending, func(p *job) bool {
+		return p.service.Name == j.service.Name && (p.preview == nil) == (j.preview == nil)
+	})
+	if i < 0 {
+		q.pending = append(q.pending, j)
+		return q.start(), nil
+	}
+	superseded = q.pending[i]
+	// only the latest state of a pull request matters for its preview
+	if j.preview == nil {
+		j.event = mergeEvents(superseded.event, j.event)
+	}
+	q.pending[i] = j
+	return q.start(), superseded
+}
+
+// ready marks j as done waiting for its checks. If nothing is running, start
+// is true and the caller is responsible for draining the queue with next.
+func (q *deployQueue) ready(j *job) (start bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j.checking = false
+	return q.start()
+}
+
+// drop removes j from the queue and reports whether it was still pending.
+func (q *deployQueue) drop(j *job) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := slices.Index(q.pending, j)
+	if i < 0 {
+		return false
+	}
+	q.pending = slices.Delete(q.pending, i, i+1)
+	return true
+}
+
+// start sets the queue running if it is idle and a job is ready.
+func (q *deployQueue) start() bool {
+	if q.running || !slices.ContainsFunc(q.pending, isReady) {
+		return false
+	}
+	q.running = true
+	return true
+}
+
+func isReady(j *job) bool {
+	return !j.checking
+}
+
+// mergeEvents returns newer as if it was pushed on top of older, which was
+// never deployed. Events without a before sha check out their commit wherever
+// the worktree is, so their before sha is left alone.
+func mergeEvents(older, newer *model.PushEvent) *model.PushEvent {
+	event := *newer
+	if event.BeforeSha != "" {
+		event.BeforeSha = older.BeforeSha
+	}
+	event.Forced = event.Forced || older.Forced
+	event.Commits = append(slices.Clone(older.Commits), event.Commits...)
+	return &event
+}
+
+// next returns the next pending job that is ready, or nil if there is none, in
+// which case the queue goes back to idle.
+func (q *deployQueue) next() *job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := slices.IndexFunc(q.pending, isReady)
+	if i < 0 {
+		q.running = false
+		return nil
+	}
+	j := q.pending[i]
+	q.pending = slices.Delete(q.pending, i, i+1)
+	return j
+}
+
+func (s *Server) getQueue(service *model.Service) *deployQueue {
+	key := filepath.Clean(service.Path)
+	s.queuesMu.Lock()
+	defer s.queuesMu.Unlock()
+	q, ok := s.queues[key]
+	if !ok {
+		q = &deployQueue{history: s.history}
+		s.queues[key] = q
+	}
+	return q
+}
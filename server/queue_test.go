@@ -0,0 +1,181 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/btschwartz12/autodeploy/model"
+	"github.com/btschwartz12/autodeploy/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestJob(service, before, after string) *job {
+	return &job{
+		service: &model.Service{Name: service},
+		event: &model.PushEvent{
+			BeforeSha: before,
+			AfterSha:  after,
+			Commits:   []model.Commit{{Sha: after}},
+		},
+	}
+}
+
+func TestQueueCoalesces(t *testing.T) {
+	q := &deployQueue{}
+
+	start, superseded := q.push(getTestJob("test", "a", "b"))
+	assert.True(t, start)
+	assert.Nil(t, superseded)
+	assert.Equal(t, "b", q.next().event.AfterSha)
+
+	// b is deploying, so c waits
+	start, superseded = q.push(getTestJob("test", "b", "c"))
+	assert.False(t, start)
+	assert.Nil(t, superseded)
+
+	// d supersedes c and has to start from b
+	start, superseded = q.push(getTestJob("test", "c", "d"))
+	assert.False(t, start)
+	assert.NotNil(t, superseded)
+	assert.Equal(t, "c", superseded.event.AfterSha)
+	assert.Len(t, superseded.event.Commits, 1)
+
+	next := q.next()
+	assert.NotNil(t, next)
+	assert.Equal(t, "b", next.event.BeforeSha)
+	assert.Equal(t, "d", next.event.AfterSha)
+	assert.Equal(t, []model.Commit{{Sha: "c"}, {Sha: "d"}}, next.event.Commits)
+
+	assert.Nil(t, q.next())
+	assert.False(t, q.running)
+
+	// the queue is idle again
+	start, _ = q.push(getTestJob("test", "d", "e"))
+	assert.True(t, start)
+}
+
+func TestQueueSharedWorktree(t *testing.T) {
+	q := &deployQueue{}
+
+	start, _ := q.push(getTestJob("api", "a", "b"))
+	assert.True(t, start)
+	assert.Equal(t, "api", q.next().service.Name)
+	_, superseded := q.push(getTestJob("web", "a", "b"))
+	assert.Nil(t, superseded)
+	_, superseded = q.push(getTestJob("api", "b", "c"))
+	assert.Nil(t, superseded)
+	_, superseded = q.push(getTestJob("web", "b", "c"))
+	assert.NotNil(t, superseded)
+
+	// services run in the order they were pushed, web only once
+	next := q.next()
+	assert.Equal(t, "web", next.service.Name)
+	assert.Equal(t, "a", next.event.BeforeSha)
+	assert.Equal(t, "c", next.event.AfterSha)
+	next = q.next()
+	assert.Equal(t, "api", next.service.Name)
+	assert.Equal(t, "b", next.event.BeforeSha)
+	assert.Equal(t, "c", next.event.AfterSha)
+	assert.Nil(t, q.next())
+}
+
+func TestQueueSkipped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "autodeploy.db")
+	history, err := store.New(path)
+	assert.NoError(t, err)
+	q := &deployQueue{history: history}
+
+	// b and c only touched other paths, so d has to start from a
+	skipped := getTestJob("test", "a", "b")
+	assert.NoError(t, q.skip(skipped.service, skipped.event))
+	skipped = getTestJob("test", "b", "c")
+	assert.NoError(t, q.skip(skipped.service, skipped.event))
+
+	// even after a restart
+	assert.NoError(t, history.Close())
+	history, err = store.New(path)
+	assert.NoError(t, err)
+	defer history.Close()
+	q = &deployQueue{history: history}
+
+	j := getTestJob("test", "c", "d")
+	assert.NoError(t, q.unskip(j))
+	start, _ := q.push(j)
+	assert.True(t, start)
+	assert.Equal(t, j, q.next())
+	assert.Equal(t, "a", j.event.BeforeSha)
+	assert.Equal(t, "d", j.event.AfterSha)
+	assert.Equal(t, []model.Commit{{Sha: "b"}, {Sha: "c"}, {Sha: "d"}}, j.event.Commits)
+
+	// the skipped pushes are only picked up once
+	j = getTestJob("test", "d", "e")
+	assert.NoError(t, q.unskip(j))
+	q.push(j)
+	assert.Equal(t, "d", q.next().event.BeforeSha)
+}
+
+func TestQueuePreview(t *testing.T) {
+	q := &deployQueue{}
+	service := &model.Service{Name: "test"}
+	getPreviewJob := func(action string) *job {
+		return &job{service: service, preview: &model.PullRequest{Number: 1, Action: action}}
+	}
+
+	start, _ := q.push(getPreviewJob(model.PullRequestOpened))
+	assert.True(t, start)
+	assert.Equal(t, model.PullRequestOpened, q.next().preview.Action)
+	_, superseded := q.push(getPreviewJob(model.PullRequestSynchronize))
+	assert.Nil(t, superseded)
+	_, superseded = q.push(getPreviewJob(model.PullRequestClosed))
+	assert.Equal(t, model.PullRequestSynchronize, superseded.preview.Action)
+
+	assert.Equal(t, model.PullRequestClosed, q.next().preview.Action)
+	assert.Nil(t, q.next())
+}
+
+func TestQueueChecking(t *testing.T) {
+	q := &deployQueue{}
+
+	// a job waiting for its checks doesn't hold up the worktree
+	checking := getTestJob("api", "a", "b")
+	checking.checking = true
+	start, _ := q.push(checking)
+	assert.False(t, start)
+	start, _ = q.push(getTestJob("web", "a", "b"))
+	assert.True(t, start)
+	assert.Equal(t, "web", q.next().service.Name)
+	assert.Nil(t, q.next())
+	assert.False(t, q.running)
+
+	// a newer push keeps the place of the one it supersedes, even while that
+	// one is still waiting for its checks
+	j := getTestJob("api", "b", "c")
+	j.checking = true
+	start, superseded := q.push(j)
+	assert.False(t, start)
+	assert.Equal(t, checking, superseded)
+	assert.Equal(t, "a", j.event.BeforeSha)
+	assert.False(t, q.ready(checking))
+
+	start, _ = q.push(getTestJob("web", "b", "c"))
+	assert.True(t, start)
+	assert.Equal(t, "web", q.next().service.Name)
+	assert.False(t, q.ready(j))
+	assert.Equal(t, j, q.next())
+	assert.Nil(t, q.next())
+
+	// checks that pass while the queue is idle start it
+	j = getTestJob("api", "c", "d")
+	j.checking = true
+	q.push(j)
+	assert.True(t, q.ready(j))
+	assert.Equal(t, j, q.next())
+
+	// failed checks drop the job
+	j = getTestJob("api", "d", "e")
+	j.checking = true
+	q.push(j)
+	assert.True(t, q.drop(j))
+	assert.False(t, q.drop(j))
+	assert.Nil(t, q.next())
+}
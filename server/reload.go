@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-playground/webhooks/v6/github"
+
+	"github.com/btschwartz12/autodeploy/config"
+)
+
+// configDebounce is how long the config file has to stay unchanged before it
+// is reloaded, since editors often write it in several steps.
+var configDebounce = 500 * time.Millisecond
+
+// Reload reads the config file again. If it is valid, the new services,
+// webhook secret and route, API token and GitHub token are used for
+// everything that starts from now on, while running deployments finish with
+// the config they started with. Otherwise the old config is kept.
+func (s *Server) Reload() error {
+	c, err := config.New(s.configPath, false)
+	if err != nil {
+		return err
+	}
+	h, err := github.New(github.Options.Secret(c.WebhookSecret))
+	if err != nil {
+		return fmt.Errorf("failed to create GitHub webhook: %w", err)
+	}
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	if c.DatabasePath != s.config.DatabasePath {
+		s.logger.Warnw("database_path only changes on restart", "database_path", s.config.DatabasePath)
+		c.DatabasePath = s.config.DatabasePath
+	}
+	deployer := s.deployer
+	if c.GithubToken != s.config.GithubToken {
+		deployer = s.deployer.WithToken(c.GithubToken)
+	}
+	s.config = c
+	s.webhook = h
+	s.deployer = deployer
+	s.router = s.newRouter(c)
+	return nil
+}
+
+// WatchConfig reloads the config on SIGHUP, and whenever the config file
+// changes if watchFile is set, until ctx is done. If the file can't be
+// watched, SIGHUP still works, since it would kill the process otherwise.
+func (s *Server) WatchConfig(ctx context.Context, watchFile bool) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	var changes <-chan struct{}
+	if watchFile {
+		var err error
+		changes, err = s.watchConfigFile(ctx)
+		if err != nil {
+			s.logger.Errorw("failed to watch config file, only reloading on SIGHUP", "path", s.configPath, "error", err)
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			s.reload("SIGHUP")
+		case <-changes:
+			s.reload("file changed")
+		}
+	}
+}
+
+func (s *Server) reload(reason string) {
+	s.logger.Infow("reloading config", "reason", reason, "path", s.configPath)
+	if err := s.Reload(); err != nil {
+		s.logger.Errorw("failed to reload config, keeping the old one", "error", err)
+		s.slackClient.SendToSlack("⚠️ failed to reload config ⚠️", []string{fmt.Sprintf("error: `%s`", err)})
+		return
+	}
+	s.logger.Infow("reloaded config", "services", len(s.getConfig().Services))
+}
+
+// watchConfigFile sends on the returned channel once the config file was
+// written to and then left alone for configDebounce.
+func (s *Server) watchConfigFile(ctx context.Context) (<-chan struct{}, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create watcher: %w", err)
+	}
+	// editors tend to replace the file rather than write to it, which only
+	// shows up in its directory
+	dir := filepath.Dir(s.configPath)
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch %s: %w", dir, err)
+	}
+	changes := make(chan struct{})
+	go func() {
+		defer watcher.Close()
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != filepath.Clean(s.configPath) {
+					continue
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				debounce = time.After(configDebounce)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				s.logger.Errorw("failed to watch config file", "error", err)
+			case <-debounce:
+				debounce = nil
+				select {
+				case changes <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return changes, nil
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// writeTestConfig writes a config with one service to path.
+func writeTestConfig(t *testing.T, path, suffix, token string) {
+	dir := filepath.Dir(path)
+	repoDir := filepath.Join(dir, "repo")
+	if _, err := os.Stat(repoDir); err != nil {
+		_, err := git.PlainInit(repoDir, false)
+		assert.NoError(t, err)
+	}
+	config := fmt.Sprintf(`
+hostname: host
+webhook_secret: secret
+webhook_url_suffix: %s
+github_token: %s
+database_path: %s
+services:
+  service1:
+    repo: example/repo1
+    path: %s
+    healthcheck_url: http://localhost:8080/health
+`, suffix, token, filepath.Join(dir, "autodeploy.db"), repoDir)
+	assert.NoError(t, os.WriteFile(path, []byte(config), 0o644))
+}
+
+func getStatus(s *Server, method, path string) int {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w.Code
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestConfig(t, path, "/postreceive", "token1")
+	s, err := NewServer(zap.NewNop().Sugar(), path)
+	assert.NoError(t, err)
+	t.Cleanup(func() { s.history.Close() })
+	assert.NotEqual(t, http.StatusNotFound, getStatus(s, http.MethodPost, "/postreceive"))
+	deployer := s.getDeployer()
+
+	// a broken config is not used
+	assert.NoError(t, os.WriteFile(path, []byte("services: ["), 0o644))
+	assert.ErrorContains(t, s.Reload(), "failed to parse config file")
+	assert.Equal(t, "/postreceive", s.getConfig().WebhookURLSuffix)
+
+	writeTestConfig(t, path, "/hook", "token1")
+	assert.NoError(t, s.Reload())
+	assert.Equal(t, http.StatusNotFound, getStatus(s, http.MethodPost, "/postreceive"))
+	assert.NotEqual(t, http.StatusNotFound, getStatus(s, http.MethodPost, "/hook"))
+	assert.Same(t, deployer, s.getDeployer())
+
+	// a new token needs a new deployer
+	writeTestConfig(t, path, "/hook", "token2")
+	assert.NoError(t, s.Reload())
+	assert.NotSame(t, deployer, s.getDeployer())
+	assert.Equal(t, "token2", s.getConfig().GithubToken)
+}
+
+func TestWatchConfigFile(t *testing.T) {
+	configDebounce = 10 * time.Millisecond
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestConfig(t, path, "/postreceive", "token1")
+	s, err := NewServer(zap.NewNop().Sugar(), path)
+	assert.NoError(t, err)
+	t.Cleanup(func() { s.history.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		s.WatchConfig(ctx, true)
+		close(done)
+	}()
+	// give the watcher a moment to start
+	time.Sleep(50 * time.Millisecond)
+
+	writeTestConfig(t, path, "/hook", "token1")
+	assert.Eventually(t, func() bool {
+		return s.getConfig().WebhookURLSuffix == "/hook"
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+}
+
+func TestWatchConfigSIGHUP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestConfig(t, path, "/postreceive", "token1")
+	s, err := NewServer(zap.NewNop().Sugar(), path)
+	assert.NoError(t, err)
+	t.Cleanup(func() { s.history.Close() })
+	// a directory that doesn't exist can't be watched
+	s.configPath = filepath.Join(t.TempDir(), "missing", "config.yaml")
+
+	// keep SIGHUP from killing the test if it comes in before WatchConfig
+	// handles it
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.WatchConfig(ctx, true)
+	time.Sleep(50 * time.Millisecond)
+
+	writeTestConfig(t, s.configPath, "/hook", "token1")
+	assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	assert.Eventually(t, func() bool {
+		return s.getConfig().WebhookURLSuffix == "/hook"
+	}, 5*time.Second, 10*time.Millisecond)
+}
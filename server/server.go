@@ -1,7 +1,10 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"sync"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-playground/webhooks/v6/github"
@@ -11,15 +14,34 @@ import (
 	"github.com/btschwartz12/autodeploy/deploy"
 	"github.com/btschwartz12/autodeploy/model"
 	"github.com/btschwartz12/autodeploy/slack"
+	"github.com/btschwartz12/autodeploy/store"
 )
 
 type Server struct {
-	router      *chi.Mux
 	logger      *zap.SugaredLogger
 	slackClient *slack.SlackClient
-	webhook     *github.Webhook
-	deployer    *deploy.Deployer
-	config      *model.Config
+	history     *store.Store
+	configPath  string
+	queues      map[string]*deployQueue
+	queuesMu    sync.Mutex
+	// deliveryJobs counts the unfinished jobs of each delivery
+	deliveryJobs map[string]int
+	deliveriesMu sync.Mutex
+
+	// deployCtx is the parent of every deployment, interrupt cuts them off
+	deployCtx context.Context
+	interrupt context.CancelCauseFunc
+	// workers counts the goroutines running queued jobs
+	workers  sync.WaitGroup
+	drainMu  sync.Mutex
+	draining bool
+
+	// stateMu guards everything that is replaced when the config is reloaded
+	stateMu  sync.RWMutex
+	config   *model.Config
+	webhook  *github.Webhook
+	deployer *deploy.Deployer
+	router   *chi.Mux
 }
 
 func NewServer(
@@ -37,21 +59,63 @@ func NewServer(
 		return nil, fmt.Errorf("failed to create GitHub webhook: %w", err)
 	}
 
+	history, err := store.New(c.DatabasePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store: %w", err)
+	}
+
+	deployCtx, interrupt := context.WithCancelCause(context.Background())
 	s := &Server{
 		logger:      logger,
 		slackClient: slack.New(),
 		webhook:     h,
-		deployer:    deploy.New(logger, c.GithubToken),
+		deployer:    deploy.New(logger, c.GithubToken, history),
+		history:     history,
+		configPath:  configPath,
 		config:      c,
+		queues:      make(map[string]*deployQueue),
+		deployCtx:   deployCtx,
+		interrupt:   interrupt,
 	}
-
-	s.router = chi.NewRouter()
-	s.router.Post(c.WebhookURLSuffix, s.handleWebhook)
-	s.router.Get("/health", s.health)
+	s.router = s.newRouter(c)
 
 	return s, nil
 }
 
-func (s *Server) GetRouter() *chi.Mux {
-	return s.router
+func (s *Server) newRouter(c *model.Config) *chi.Mux {
+	router := chi.NewRouter()
+	router.Post(c.WebhookURLSuffix, s.handleWebhook)
+	router.Get("/health", s.health)
+	if c.APIToken != "" {
+		router.Route("/api", s.apiRoutes)
+	} else {
+		s.logger.Infow("api_token not set, API is disabled")
+	}
+	return router
+}
+
+// ServeHTTP routes r with the router for the current config.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.stateMu.RLock()
+	router := s.router
+	s.stateMu.RUnlock()
+	router.ServeHTTP(w, r)
+}
+
+func (s *Server) getConfig() *model.Config {
+	s.stateMu.RLock()
+	defer s.stateMu.RUnlock()
+	return s.config
+}
+
+func (s *Server) getWebhook() *github.Webhook {
+	s.stateMu.RLock()
+	defer s.stateMu.RUnlock()
+	return s.webhook
+}
+
+func (s *Server) getDeployer() *deploy.Deployer {
+	s.stateMu.RLock()
+	defer s.stateMu.RUnlock()
+	return s.deployer
 }
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/btschwartz12/autodeploy/deploy"
+)
+
+// startWorker reports whether a goroutine may start running queued jobs, and
+// counts it if so.
+func (s *Server) startWorker() bool {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	if s.draining {
+		return false
+	}
+	s.workers.Add(1)
+	return true
+}
+
+func (s *Server) isDraining() bool {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	return s.draining
+}
+
+// GracePeriod is how long Shutdown should wait for running deployments.
+func (s *Server) GracePeriod() time.Duration {
+	return time.Duration(s.getConfig().ShutdownGracePeriod)
+}
+
+// Shutdown stops starting deployments, including queued ones, and waits for
+// the running ones to finish. Once ctx is done, the running ones are
+// interrupted, and Shutdown waits for them to record that before it returns
+// ctx's error.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.drainMu.Lock()
+	s.draining = true
+	s.drainMu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	s.logger.Warnw("grace period is over, interrupting running deployments")
+	s.interrupt(deploy.ErrInterrupted)
+	<-done
+	return ctx.Err()
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/btschwartz12/autodeploy/deploy"
+)
+
+func getTestShutdownServer() *Server {
+	deployCtx, interrupt := context.WithCancelCause(context.Background())
+	return &Server{
+		logger:    zap.NewNop().Sugar(),
+		deployCtx: deployCtx,
+		interrupt: interrupt,
+	}
+}
+
+func TestShutdownWaits(t *testing.T) {
+	s := getTestShutdownServer()
+	assert.True(t, s.startWorker())
+	time.AfterFunc(50*time.Millisecond, s.workers.Done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, s.Shutdown(ctx))
+	assert.NoError(t, s.deployCtx.Err())
+	assert.False(t, s.startWorker())
+}
+
+func TestShutdownInterrupts(t *testing.T) {
+	s := getTestShutdownServer()
+	assert.True(t, s.startWorker())
+	go func() {
+		<-s.deployCtx.Done()
+		s.workers.Done()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	assert.ErrorIs(t, context.Cause(s.deployCtx), deploy.ErrInterrupted)
+}
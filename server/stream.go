@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/btschwartz12/autodeploy/model"
+	"github.com/btschwartz12/autodeploy/store"
+)
+
+// streamDeployment sends the output of a deployment as Server-Sent Events.
+// Output that was already produced is replayed first. While the deployment
+// is running, new lines are sent as they happen, and a final "done" event
+// carries the finished record.
+func (s *Server) streamDeployment(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid deployment id")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	// subscribe before reading the record, so no lines are missed if the
+	// deployment finishes in between
+	var replay []model.OutputLine
+	var lines <-chan model.OutputLine
+	if out := s.getDeployer().Watch(id); out != nil {
+		var cancel func()
+		replay, lines, cancel = out.Subscribe()
+		defer cancel()
+	}
+	deployment, err := s.history.GetDeployment(id)
+	if errors.Is(err, store.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "deployment not found")
+		return
+	}
+	if err != nil {
+		s.logger.Errorw("failed to get deployment", "id", id, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to get deployment")
+		return
+	}
+	if lines == nil {
+		replay, err = s.history.GetDeploymentOutput(id)
+		if err != nil {
+			s.logger.Errorw("failed to get deployment output", "id", id, "error", err)
+			writeError(w, http.StatusInternalServerError, "failed to get deployment output")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, line := range replay {
+		writeEvent(w, line.Kind, line)
+	}
+	flusher.Flush()
+
+	if lines != nil {
+		for done := false; !done; {
+			select {
+			case <-r.Context().Done():
+				return
+			case line, ok := <-lines:
+				if !ok {
+					done = true
+					break
+				}
+				writeEvent(w, line.Kind, line)
+				flusher.Flush()
+			}
+		}
+		deployment, err = s.history.GetDeployment(id)
+		if err != nil {
+			s.logger.Errorw("failed to get deployment", "id", id, "error", err)
+			return
+		}
+	}
+	if !deployment.IsFinished() {
+		// we fell behind, or the deployment is running in a process that
+		// is gone. either way the client has to reconnect.
+		return
+	}
+	writeEvent(w, "done", deployment)
+	flusher.Flush()
+}
+
+func writeEvent(w http.ResponseWriter, event string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/btschwartz12/autodeploy/model"
+)
+
+// deliveriesBucket holds webhook deliveries keyed by their delivery ID.
+var deliveriesBucket = []byte("deliveries")
+
+// SaveDelivery creates or overwrites the delivery with d's ID.
+func (s *Store) SaveDelivery(d *model.Delivery) error {
+	v, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("failed to marshal delivery: %w", err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deliveriesBucket).Put([]byte(d.ID), v)
+	})
+}
+
+// CreateDelivery saves a newly received delivery, unless one with the same
+// ID was received after since and did not fail, in which case d is a
+// redelivery of it and duplicate is true.
+func (s *Store) CreateDelivery(d *model.Delivery, since time.Time) (duplicate bool, err error) {
+	v, err := json.Marshal(d)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal delivery: %w", err)
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(deliveriesBucket)
+		if existing := b.Get([]byte(d.ID)); existing != nil {
+			var e model.Delivery
+			if err := json.Unmarshal(existing, &e); err != nil {
+				return fmt.Errorf("failed to unmarshal delivery %s: %w", d.ID, err)
+			}
+			if e.State != model.DeliveryFailed && e.ReceivedAt.After(since) {
+				duplicate = true
+				return nil
+			}
+		}
+		return b.Put([]byte(d.ID), v)
+	})
+	return duplicate, err
+}
+
+func (s *Store) GetDelivery(id string) (*model.Delivery, error) {
+	var d model.Delivery
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(deliveriesBucket).Get([]byte(id))
+		if v == nil {
+			return fmt.Errorf("delivery %s: %w", id, ErrNotFound)
+		}
+		return json.Unmarshal(v, &d)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// ListDeliveries returns the deliveries in state, or all of them if state is
+// empty, oldest first.
+func (s *Store) ListDeliveries(state model.DeliveryState) ([]model.Delivery, error) {
+	deliveries := make([]model.Delivery, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(deliveriesBucket).ForEach(func(k, v []byte) error {
+			var d model.Delivery
+			if err := json.Unmarshal(v, &d); err != nil {
+				return fmt.Errorf("failed to unmarshal delivery %s: %w", k, err)
+			}
+			if state == "" || d.State == state {
+				deliveries = append(deliveries, d)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(deliveries, func(a, b model.Delivery) int {
+		return a.ReceivedAt.Compare(b.ReceivedAt)
+	})
+	return deliveries, nil
+}
+
+// PruneDeliveries deletes the finished deliveries received before before,
+// and returns how many it deleted.
+func (s *Store) PruneDeliveries(before time.Time) (int, error) {
+	pruned := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(deliveriesBucket)
+		// deleting while iterating with a cursor skips keys
+		keys := make([][]byte, 0)
+		err := b.ForEach(func(k, v []byte) error {
+			var d model.Delivery
+			if err := json.Unmarshal(v, &d); err != nil {
+				return fmt.Errorf("failed to unmarshal delivery %s: %w", k, err)
+			}
+			if d.State != model.DeliveryPending && d.ReceivedAt.Before(before) {
+				keys = append(keys, slices.Clone(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return fmt.Errorf("failed to delete delivery %s: %w", k, err)
+			}
+		}
+		pruned = len(keys)
+		return nil
+	})
+	return pruned, err
+}
@@ -0,0 +1,83 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btschwartz12/autodeploy/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "autodeploy.db")
+	s, err := New(path)
+	assert.NoError(t, err)
+
+	now := time.Now()
+	for i, id := range []string{"c", "a", "b"} {
+		d := &model.Delivery{
+			ID:         id,
+			Event:      "push",
+			Payload:    []byte(`{"ref":"refs/heads/main"}`),
+			State:      model.DeliveryPending,
+			ReceivedAt: now.Add(time.Duration(i) * time.Hour),
+		}
+		assert.NoError(t, s.SaveDelivery(d))
+	}
+	a, err := s.GetDelivery("a")
+	assert.NoError(t, err)
+	a.State = model.DeliveryDone
+	assert.NoError(t, s.SaveDelivery(a))
+	_, err = s.GetDelivery("d")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// deliveries survive a restart
+	assert.NoError(t, s.Close())
+	s, err = New(path)
+	assert.NoError(t, err)
+	defer s.Close()
+
+	pending, err := s.ListDeliveries(model.DeliveryPending)
+	assert.NoError(t, err)
+	assert.Len(t, pending, 2)
+	assert.Equal(t, "c", pending[0].ID)
+	assert.Equal(t, "b", pending[1].ID)
+	assert.JSONEq(t, `{"ref":"refs/heads/main"}`, string(pending[0].Payload))
+
+	// pending deliveries are kept no matter how old
+	pruned, err := s.PruneDeliveries(now.Add(3 * time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pruned)
+	all, err := s.ListDeliveries("")
+	assert.NoError(t, err)
+	assert.Len(t, all, 2)
+}
+
+func TestCreateDelivery(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "autodeploy.db"))
+	assert.NoError(t, err)
+	defer s.Close()
+
+	now := time.Now()
+	since := now.Add(-time.Hour)
+	d := &model.Delivery{ID: "a", State: model.DeliveryPending, ReceivedAt: now}
+	duplicate, err := s.CreateDelivery(d, since)
+	assert.NoError(t, err)
+	assert.False(t, duplicate)
+	duplicate, err = s.CreateDelivery(d, since)
+	assert.NoError(t, err)
+	assert.True(t, duplicate)
+
+	// failed deliveries may be redelivered
+	d.State = model.DeliveryFailed
+	assert.NoError(t, s.SaveDelivery(d))
+	duplicate, err = s.CreateDelivery(&model.Delivery{ID: "a", State: model.DeliveryPending, ReceivedAt: now}, since)
+	assert.NoError(t, err)
+	assert.False(t, duplicate)
+
+	// and so may deliveries from before the window
+	duplicate, err = s.CreateDelivery(d, now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.False(t, duplicate)
+}
@@ -0,0 +1,171 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/btschwartz12/autodeploy/model"
+)
+
+var (
+	deploymentsBucket = []byte("deployments")
+	// outputsBucket holds the output of each deployment by ID, apart from the
+	// records, so listing deployments doesn't decode it.
+	outputsBucket = []byte("outputs")
+)
+
+// CreateDeployment saves a new deployment record and assigns its ID.
+func (s *Store) CreateDeployment(d *model.Deployment) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		id, err := tx.Bucket(deploymentsBucket).NextSequence()
+		if err != nil {
+			return fmt.Errorf("failed to get next id: %w", err)
+		}
+		d.ID = id
+		return putDeployment(tx, d)
+	})
+}
+
+// UpdateDeployment overwrites an existing deployment record. The stored
+// output is only replaced if d has any.
+func (s *Store) UpdateDeployment(d *model.Deployment) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(deploymentsBucket).Get(itob(d.ID)) == nil {
+			return fmt.Errorf("deployment %d: %w", d.ID, ErrNotFound)
+		}
+		return putDeployment(tx, d)
+	})
+}
+
+// GetDeployment returns a deployment record without its output, see
+// GetDeploymentOutput.
+func (s *Store) GetDeployment(id uint64) (*model.Deployment, error) {
+	var d model.Deployment
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(deploymentsBucket).Get(itob(id))
+		if v == nil {
+			return fmt.Errorf("deployment %d: %w", id, ErrNotFound)
+		}
+		return json.Unmarshal(v, &d)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// GetDeploymentOutput returns the output of a deployment, or nil if it has
+// none.
+func (s *Store) GetDeploymentOutput(id uint64) ([]model.OutputLine, error) {
+	var output []model.OutputLine
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(outputsBucket).Get(itob(id))
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, &output)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func putDeployment(tx *bolt.Tx, d *model.Deployment) error {
+	if d.Output != nil {
+		v, err := json.Marshal(d.Output)
+		if err != nil {
+			return fmt.Errorf("failed to marshal output: %w", err)
+		}
+		if err := tx.Bucket(outputsBucket).Put(itob(d.ID), v); err != nil {
+			return err
+		}
+	}
+	record := *d
+	record.Output = nil
+	v, err := json.Marshal(&record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal deployment: %w", err)
+	}
+	return tx.Bucket(deploymentsBucket).Put(itob(d.ID), v)
+}
+
+// itob encodes ids big-endian so that keys sort in the order they were created
+func itob(id uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, id)
+	return b
+}
+
+func btoi(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
+
+// DeploymentFilter selects deployments in ListDeployments. Zero fields match
+// everything.
+type DeploymentFilter struct {
+	Service string
+	State   model.DeploymentState
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+func (f *DeploymentFilter) matches(d *model.Deployment) bool {
+	if f.Service != "" && d.Service != f.Service {
+		return false
+	}
+	if f.State != "" && d.State != f.State {
+		return false
+	}
+	if !f.Since.IsZero() && d.StartedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && d.StartedAt.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// ListDeployments returns the deployments matching filter, newest first.
+func (s *Store) ListDeployments(filter DeploymentFilter) ([]model.Deployment, error) {
+	deployments := make([]model.Deployment, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(deploymentsBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var d model.Deployment
+			if err := json.Unmarshal(v, &d); err != nil {
+				return fmt.Errorf("failed to unmarshal deployment %d: %w", btoi(k), err)
+			}
+			if !filter.matches(&d) {
+				continue
+			}
+			deployments = append(deployments, d)
+			if filter.Limit > 0 && len(deployments) >= filter.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deployments, nil
+}
+
+// LatestDeployment returns the most recent deployment of service, or nil if
+// it has never been deployed.
+func (s *Store) LatestDeployment(service string) (*model.Deployment, error) {
+	deployments, err := s.ListDeployments(DeploymentFilter{Service: service, Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(deployments) == 0 {
+		return nil, nil
+	}
+	return &deployments[0], nil
+}
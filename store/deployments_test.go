@@ -0,0 +1,91 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/btschwartz12/autodeploy/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestDeployment(service string) *model.Deployment {
+	return model.NewDeployment(
+		&model.Service{Name: service},
+		&model.PushEvent{
+			Ref:       "refs/heads/main",
+			BeforeSha: "53272ee3b33edfe8ba8db18881f25fb9a5234288",
+			AfterSha:  "8e9703b922474b3d78aba29f388ea038396aab8d",
+			Pusher:    "torvalds",
+			Commits: []model.Commit{
+				{Sha: "8e9703b922474b3d78aba29f388ea038396aab8d", Message: "y"},
+			},
+		},
+	)
+}
+
+func TestDeployments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "autodeploy.db")
+	s, err := New(path)
+	assert.NoError(t, err)
+
+	first := getTestDeployment("service1")
+	assert.NoError(t, s.CreateDeployment(first))
+	second := getTestDeployment("service2")
+	assert.NoError(t, s.CreateDeployment(second))
+	assert.Equal(t, uint64(1), first.ID)
+	assert.Equal(t, uint64(2), second.ID)
+
+	first.Phases = append(first.Phases, model.Phase{Name: "pre", Error: "failed to pull"})
+	first.State = model.DeploymentFailure
+	assert.NoError(t, s.UpdateDeployment(first))
+
+	_, err = s.GetDeployment(3)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, s.UpdateDeployment(&model.Deployment{ID: 3}), ErrNotFound)
+
+	// records survive a restart
+	assert.NoError(t, s.Close())
+	s, err = New(path)
+	assert.NoError(t, err)
+	defer s.Close()
+
+	got, err := s.GetDeployment(first.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "service1", got.Service)
+	assert.Equal(t, model.DeploymentFailure, got.State)
+	assert.Equal(t, "torvalds", got.Pusher)
+	assert.Len(t, got.Commits, 1)
+	assert.Equal(t, []model.Phase{{Name: "pre", Error: "failed to pull"}}, got.Phases)
+	assert.WithinDuration(t, first.StartedAt, got.StartedAt, 0)
+}
+
+func TestDeploymentOutput(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "autodeploy.db"))
+	assert.NoError(t, err)
+	defer s.Close()
+
+	d := getTestDeployment("service1")
+	d.Output = []model.OutputLine{{Kind: model.OutputKindPhase, Text: "pre started"}}
+	assert.NoError(t, s.CreateDeployment(d))
+	d.Output = append(d.Output, model.OutputLine{Kind: model.OutputKindOutput, Text: "$ make build"})
+	assert.NoError(t, s.UpdateDeployment(d))
+
+	// records come without their output
+	got, err := s.GetDeployment(d.ID)
+	assert.NoError(t, err)
+	assert.Nil(t, got.Output)
+	deployments, err := s.ListDeployments(DeploymentFilter{})
+	assert.NoError(t, err)
+	assert.Nil(t, deployments[0].Output)
+
+	// updating a record without output keeps it
+	got.State = model.DeploymentInterrupted
+	assert.NoError(t, s.UpdateDeployment(got))
+	output, err := s.GetDeploymentOutput(d.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, d.Output, output)
+
+	output, err = s.GetDeploymentOutput(2)
+	assert.NoError(t, err)
+	assert.Nil(t, output)
+}
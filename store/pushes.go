@@ -0,0 +1,76 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// pushesBucket remembers which delivery first brought each push, keyed by
+// the caller's key for the push.
+var pushesBucket = []byte("pushes")
+
+type seenPush struct {
+	Delivery string    `json:"delivery"`
+	SeenAt   time.Time `json:"seen_at"`
+}
+
+// ClaimPush records that delivery brought the push with key. If another
+// delivery already did so after since, nothing is recorded and that
+// delivery's ID is returned.
+func (s *Store) ClaimPush(key, delivery string, since time.Time) (owner string, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pushesBucket)
+		if v := b.Get([]byte(key)); v != nil {
+			var seen seenPush
+			if err := json.Unmarshal(v, &seen); err != nil {
+				return fmt.Errorf("failed to unmarshal push %s: %w", key, err)
+			}
+			if seen.Delivery != delivery && seen.SeenAt.After(since) {
+				owner = seen.Delivery
+				return nil
+			}
+		}
+		v, err := json.Marshal(seenPush{Delivery: delivery, SeenAt: time.Now()})
+		if err != nil {
+			return fmt.Errorf("failed to marshal push: %w", err)
+		}
+		return b.Put([]byte(key), v)
+	})
+	return owner, err
+}
+
+// PrunePushes forgets the pushes seen before before, and returns how many it
+// forgot.
+func (s *Store) PrunePushes(before time.Time) (int, error) {
+	pruned := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pushesBucket)
+		// deleting while iterating with a cursor skips keys
+		keys := make([][]byte, 0)
+		err := b.ForEach(func(k, v []byte) error {
+			var seen seenPush
+			if err := json.Unmarshal(v, &seen); err != nil {
+				return fmt.Errorf("failed to unmarshal push %s: %w", k, err)
+			}
+			if seen.SeenAt.Before(before) {
+				keys = append(keys, slices.Clone(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return fmt.Errorf("failed to delete push %s: %w", k, err)
+			}
+		}
+		pruned = len(keys)
+		return nil
+	})
+	return pruned, err
+}
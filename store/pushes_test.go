@@ -0,0 +1,46 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaimPush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "autodeploy.db")
+	s, err := New(path)
+	assert.NoError(t, err)
+
+	since := time.Now().Add(-time.Hour)
+	owner, err := s.ClaimPush("example/repo main 1 2", "a", since)
+	assert.NoError(t, err)
+	assert.Empty(t, owner)
+	// the same delivery may claim it again, e.g. when it is resumed
+	owner, err = s.ClaimPush("example/repo main 1 2", "a", since)
+	assert.NoError(t, err)
+	assert.Empty(t, owner)
+
+	// claims survive a restart
+	assert.NoError(t, s.Close())
+	s, err = New(path)
+	assert.NoError(t, err)
+	defer s.Close()
+
+	owner, err = s.ClaimPush("example/repo main 1 2", "b", since)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", owner)
+	owner, err = s.ClaimPush("example/repo main 2 3", "b", since)
+	assert.NoError(t, err)
+	assert.Empty(t, owner)
+
+	// once the window has passed, the push may be deployed again
+	owner, err = s.ClaimPush("example/repo main 1 2", "b", time.Now())
+	assert.NoError(t, err)
+	assert.Empty(t, owner)
+
+	pruned, err := s.PrunePushes(time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, pruned)
+}
@@ -0,0 +1,52 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/btschwartz12/autodeploy/model"
+)
+
+// skippedBucket holds the pushes per service that were not deployed because
+// they did not touch any of its paths, keyed by service name.
+var skippedBucket = []byte("skipped")
+
+// SkippedPush returns the push skipped for service, or nil if there is none.
+func (s *Store) SkippedPush(service string) (*model.PushEvent, error) {
+	var event *model.PushEvent
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(skippedBucket).Get([]byte(service))
+		if v == nil {
+			return nil
+		}
+		event = &model.PushEvent{}
+		if err := json.Unmarshal(v, event); err != nil {
+			return fmt.Errorf("failed to unmarshal skipped push of %s: %w", service, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// SaveSkippedPush replaces the push skipped for service.
+func (s *Store) SaveSkippedPush(service string, event *model.PushEvent) error {
+	v, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal skipped push: %w", err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(skippedBucket).Put([]byte(service), v)
+	})
+}
+
+// DeleteSkippedPush forgets the push skipped for service.
+func (s *Store) DeleteSkippedPush(service string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(skippedBucket).Delete([]byte(service))
+	})
+}
@@ -0,0 +1,40 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/btschwartz12/autodeploy/model"
+)
+
+func TestSkippedPush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "autodeploy.db")
+	s, err := New(path)
+	assert.NoError(t, err)
+
+	event, err := s.SkippedPush("service1")
+	assert.NoError(t, err)
+	assert.Nil(t, event)
+	assert.NoError(t, s.SaveSkippedPush("service1", &model.PushEvent{BeforeSha: "a", AfterSha: "b"}))
+
+	// skipped pushes survive a restart
+	assert.NoError(t, s.Close())
+	s, err = New(path)
+	assert.NoError(t, err)
+	defer s.Close()
+
+	event, err = s.SkippedPush("service1")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", event.BeforeSha)
+	assert.Equal(t, "b", event.AfterSha)
+	event, err = s.SkippedPush("service2")
+	assert.NoError(t, err)
+	assert.Nil(t, event)
+
+	assert.NoError(t, s.DeleteSkippedPush("service1"))
+	event, err = s.SkippedPush("service1")
+	assert.NoError(t, err)
+	assert.Nil(t, event)
+}